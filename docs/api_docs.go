@@ -60,6 +60,10 @@ const docTemplateapi = `{
                                 "type": "string",
                                 "description": "API Key parsed from request."
                             },
+                            "X-Auth-Stale": {
+                                "type": "string",
+                                "description": "Set to 1 when the database failed and a stale cached user was served."
+                            },
                             "X-Environment": {
                                 "type": "string",
                                 "description": "Environment: live, dev, etc."
@@ -150,6 +154,171 @@ const docTemplateapi = `{
                 }
             }
         },
+        "/auth/traefik": {
+            "get": {
+                "description": "Retrieve the environment for an API Key or Server ID. This endpoint is designed for forward auth proxies:\nTraefik ForwardAuth, Caddy forward_auth and HAProxy. They send the original request in X-Forwarded-Uri,\nX-Forwarded-Host and X-Forwarded-Method. The API key is parsed from X-Api-Key or X-Forwarded-Uri.\n/auth accepts the same requests, see proxy_mode. This path treats every request as forward auth.",
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Get user or server environment for forward auth proxies",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Discord Server ID to route.",
+                        "name": "X-Server",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "User's API Key to route, or the shared website secret when X-Server is provided.",
+                        "name": "X-Api-Key",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "User's API Key may be provided in this header at URI position 5: /api/v1/route/method/{key}",
+                        "name": "X-Forwarded-Uri",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Body is empty on success, check headers.",
+                        "headers": {
+                            "Age": {
+                                "type": "string",
+                                "description": "How long this information has been in the cache."
+                            },
+                            "X-Api-Key": {
+                                "type": "string",
+                                "description": "API Key parsed from request."
+                            },
+                            "X-Auth-Stale": {
+                                "type": "string",
+                                "description": "Set to 1 when the database failed and a stale cached user was served."
+                            },
+                            "X-Environment": {
+                                "type": "string",
+                                "description": "Environment: live, dev, etc."
+                            },
+                            "X-UserID": {
+                                "type": "string",
+                                "description": "MySQL ID for the user whose API key was provided."
+                            },
+                            "X-Username": {
+                                "type": "string",
+                                "description": "Username for the user whose API key was provided."
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "invalid request",
+                        "schema": {
+                            "type": "string"
+                        },
+                        "headers": {
+                            "X-Api-Key": {
+                                "type": "string",
+                                "description": "API Key parsed from request."
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/cache": {
+            "delete": {
+                "description": "Delete every cached user and server that matches all of the provided filters, from the users,\nservers and stale caches. Use this when a user is banned or rotates their keys.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Delete Matching Cache Entries",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Delete the entries for this user ID.",
+                        "name": "userId",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Delete the entries for this username.",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Delete the entries in this environment.",
+                        "name": "environment",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Delete the entries with an API key that starts with this prefix.",
+                        "name": "prefix",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "List of cached info for API Keys and servers that were deleted.",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "allOf": [
+                                    {
+                                        "$ref": "#/definitions/cache.Item"
+                                    },
+                                    {
+                                        "type": "object",
+                                        "properties": {
+                                            "data": {
+                                                "$ref": "#/definitions/userinfo.UserInfo"
+                                            }
+                                        }
+                                    }
+                                ]
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "no filter provided",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "invalid request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/healthz": {
+            "get": {
+                "description": "Liveness check. Returns 200 while the process is running.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Liveness check",
+                "responses": {
+                    "200": {
+                        "description": "Process is alive.",
+                        "schema": {
+                            "$ref": "#/definitions/webserver.healthReply"
+                        }
+                    }
+                }
+            }
+        },
         "/metrics": {
             "get": {
                 "description": "Retrieve internal application metrics.",
@@ -164,6 +333,38 @@ const docTemplateapi = `{
                     "200": {
                         "description": "Auth Proxy Prometheus metrics",
                         "schema": {}
+                    },
+                    "401": {
+                        "description": "invalid request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/readyz": {
+            "get": {
+                "description": "Readiness check. Returns 200 when the database answers a ping within ready_timeout.\nReturns 503 otherwise, and once shutdown begins. The ping result is reused for 2 seconds.\nThe caches are created before the listener starts, so they are not checked.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Readiness check",
+                "responses": {
+                    "200": {
+                        "description": "Ready to serve auth requests.",
+                        "schema": {
+                            "$ref": "#/definitions/webserver.healthReply"
+                        }
+                    },
+                    "503": {
+                        "description": "Not ready. Check the failed checks.",
+                        "schema": {
+                            "$ref": "#/definitions/webserver.healthReply"
+                        }
                     }
                 }
             }
@@ -185,6 +386,12 @@ const docTemplateapi = `{
                             "type": "string"
                         }
                     },
+                    "401": {
+                        "description": "invalid request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "error reading config",
                         "schema": {
@@ -269,34 +476,81 @@ const docTemplateapi = `{
         },
         "/stats/keys": {
             "get": {
-                "description": "Retrieve full cached user list.",
+                "description": "Retrieve a page of the cached user list. API keys are masked unless unmask=true\nand the admin allow_unmask setting is enabled.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
                     "stats"
                 ],
-                "summary": "Return all cached users",
+                "summary": "Return cached users",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Users per page, 1 to 1000. Default: 100.",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Users to skip.",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "key (default), access or created. Access and created are newest first.",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only users in this environment.",
+                        "name": "environment",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only users with this username.",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only users with this user ID.",
+                        "name": "userId",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only users cached at least this long ago, e.g. 10m.",
+                        "name": "minAge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only users cached at most this long ago, e.g. 1h.",
+                        "name": "maxAge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Show full API keys. Requires allow_unmask.",
+                        "name": "unmask",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
-                        "description": "List of cached API keys. The map key is the API key.",
+                        "description": "Page of cached users. The key is the API key.",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "allOf": [
-                                    {
-                                        "$ref": "#/definitions/cache.Item"
-                                    },
-                                    {
-                                        "type": "object",
-                                        "properties": {
-                                            "data": {
-                                                "$ref": "#/definitions/userinfo.UserInfo"
-                                            }
-                                        }
-                                    }
-                                ]
-                            }
+                            "$ref": "#/definitions/webserver.CachePage"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid query",
+                        "schema": {
+                            "type": "string"
                         }
                     },
                     "401": {
@@ -304,13 +558,19 @@ const docTemplateapi = `{
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "403": {
+                        "description": "unmask is not allowed",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
         },
         "/stats/server/{key}": {
             "get": {
-                "description": "Retrieve a cached server's info.",
+                "description": "Retrieve a cached server's info. The owner's API key is masked unless unmask=true\nand the admin allow_unmask setting is enabled.",
                 "produces": [
                     "application/json"
                 ],
@@ -325,6 +585,12 @@ const docTemplateapi = `{
                         "name": "key",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Show the full API key. Requires allow_unmask.",
+                        "name": "unmask",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -346,45 +612,68 @@ const docTemplateapi = `{
                             ]
                         }
                     },
+                    "400": {
+                        "description": "invalid query",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "401": {
                         "description": "invalid request",
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "403": {
+                        "description": "unmask is not allowed",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
         },
         "/stats/servers": {
             "get": {
-                "description": "Retrieve full cached server list.",
+                "description": "Retrieve a page of the cached server list. API keys are masked unless unmask=true\nand the admin allow_unmask setting is enabled.\nTakes the same paging, sort and filter parameters as /stats/keys.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
                     "stats"
                 ],
-                "summary": "Return all cached servers",
+                "summary": "Return cached servers",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Servers per page, 1 to 1000. Default: 100.",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Servers to skip.",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Show full API keys. Requires allow_unmask.",
+                        "name": "unmask",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
-                        "description": "Cached servers. Mp key is server ID.",
+                        "description": "Page of cached servers. The key is the server ID.",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "allOf": [
-                                    {
-                                        "$ref": "#/definitions/cache.Item"
-                                    },
-                                    {
-                                        "type": "object",
-                                        "properties": {
-                                            "data": {
-                                                "$ref": "#/definitions/userinfo.UserInfo"
-                                            }
-                                        }
-                                    }
-                                ]
-                            }
+                            "$ref": "#/definitions/webserver.CachePage"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid query",
+                        "schema": {
+                            "type": "string"
                         }
                     },
                     "401": {
@@ -392,12 +681,53 @@ const docTemplateapi = `{
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "403": {
+                        "description": "unmask is not allowed",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
+        },
+        "/stats/top": {
+            "get": {
+                "description": "Retrieve the user IDs and masked API keys with the most auth requests, per window.\nCounts are approximate, and may be overcounted by up to the error.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "stats"
+                ],
+                "summary": "Return the most active users and keys",
+                "responses": {
+                    "200": {
+                        "description": "Most active users and keys, shortest window first.",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/webserver.TopWindow"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "invalid request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "top tracking is not enabled",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
         "cache.Item": {
             "type": "object",
             "properties": {
@@ -439,6 +769,70 @@ const docTemplateapi = `{
                 "Hour"
             ]
         },
+        "userinfo.BreakerConfig": {
+            "type": "object",
+            "properties": {
+                "cooldown": {
+                    "description": "Cooldown is how long the breaker stays open before probing. Default: 10s.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "errors": {
+                    "description": "Errors is the number of consecutive failures that open the breaker. 0 disables the breaker.",
+                    "type": "integer"
+                },
+                "latency": {
+                    "description": "Latency counts lookups slower than this as failures. 0 disables the latency threshold.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "probes": {
+                    "description": "Probes is the number of successful probes required to close the breaker. Default: 1.",
+                    "type": "integer"
+                }
+            }
+        },
+        "userinfo.HostConfig": {
+            "type": "object",
+            "properties": {
+                "host": {
+                    "type": "string"
+                },
+                "role": {
+                    "description": "Role is primary or replica. Default: primary.",
+                    "type": "string"
+                }
+            }
+        },
+        "userinfo.QueryConfig": {
+            "type": "object",
+            "properties": {
+                "server": {
+                    "type": "string"
+                },
+                "serverColumns": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "user": {
+                    "type": "string"
+                },
+                "userColumns": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
         "userinfo.UserInfo": {
             "type": "object",
             "properties": {
@@ -448,6 +842,17 @@ const docTemplateapi = `{
                 "environment": {
                     "type": "string"
                 },
+                "rateLimit": {
+                    "description": "RateLimit is the user's own quota: RateLimit requests every RatePeriod seconds.",
+                    "type": "integer"
+                },
+                "ratePeriod": {
+                    "type": "integer"
+                },
+                "rateTier": {
+                    "description": "RateTier is the user's rate limit tier. The tiers are configured in the proxy.",
+                    "type": "string"
+                },
                 "userId": {
                     "type": "string"
                 },
@@ -456,9 +861,118 @@ const docTemplateapi = `{
                 }
             }
         },
+        "webserver.AdminConfig": {
+            "type": "object",
+            "properties": {
+                "allowNets": {
+                    "description": "AllowNets is a list of CIDRs or IPs allowed to reach the admin endpoints.\nThe request's remote address is used; X-Forwarded-For is not trusted.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "allowUnmask": {
+                    "description": "AllowUnmask allows unmask=true on /stats/keys, /stats/servers and /stats/server/{id} to show full API keys.",
+                    "type": "boolean"
+                }
+            }
+        },
+        "webserver.CacheItem": {
+            "type": "object",
+            "properties": {
+                "created": {
+                    "type": "string"
+                },
+                "data": {
+                    "$ref": "#/definitions/userinfo.UserInfo"
+                },
+                "hits": {
+                    "type": "integer"
+                },
+                "key": {
+                    "type": "string"
+                },
+                "lastAccess": {
+                    "type": "string"
+                }
+            }
+        },
+        "webserver.CachePage": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/webserver.CacheItem"
+                    }
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "total": {
+                    "description": "Total is how many items matched the filters, before paging.",
+                    "type": "integer"
+                }
+            }
+        },
         "webserver.Config": {
             "type": "object",
             "properties": {
+                "admin": {
+                    "description": "Admin protects the stats, reload, metrics and docs endpoints.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/webserver.AdminConfig"
+                        }
+                    ]
+                },
+                "breaker": {
+                    "description": "Breaker wraps database lookups with a circuit breaker (optional).",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/userinfo.BreakerConfig"
+                        }
+                    ]
+                },
+                "cacheFile": {
+                    "description": "CacheFile is where the users and servers caches are saved on shutdown, and loaded from on startup.",
+                    "type": "string"
+                },
+                "cacheFileMaxAge": {
+                    "description": "CacheFileMaxAge drops items older than this when loading the CacheFile. 0 keeps every item.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "cacheMaxAge": {
+                    "description": "CacheMaxAge expires valid users and servers from the cache after this long. 0 keeps them until deleted.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "cacheRefresh": {
+                    "description": "CacheRefresh re-queries cached valid users in the background once they are this old. 0 disables.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "cacheSaveInterval": {
+                    "description": "CacheSaveInterval also saves the CacheFile periodically. 0 only saves on shutdown.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
                 "cacheShards": {
                     "description": "CacheShards is golift.io/cache partition count for users and servers; 0 means library default (single shard).",
                     "type": "integer"
@@ -469,18 +983,64 @@ const docTemplateapi = `{
                 "connMaxLifetime": {
                     "$ref": "#/definitions/time.Duration"
                 },
+                "driver": {
+                    "description": "Driver selects the Backend implementation. Defaults to mysql.",
+                    "type": "string"
+                },
                 "errorFile": {
                     "type": "string"
                 },
+                "errorTarget": {
+                    "description": "ErrorTarget is where the error log goes. Same values as LogTarget, with error_file and stderr.",
+                    "type": "string"
+                },
+                "grpcListenAddr": {
+                    "description": "GRPCListenAddr is where the Envoy ext_authz gRPC server listens. Empty disables it.",
+                    "type": "string"
+                },
+                "healthInterval": {
+                    "description": "HealthInterval is how often hosts marked down are re-checked. Default: 30s.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
                 "host": {
                     "type": "string"
                 },
+                "hosts": {
+                    "description": "Hosts lists database hosts and their roles (optional). When empty, Host is the only (primary) host.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/userinfo.HostConfig"
+                    }
+                },
+                "keyRules": {
+                    "description": "KeyRules are tried in order to find the API key in a request. Default: X-Api-Key, then uri path segment 5.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/webserver.KeyRule"
+                    }
+                },
                 "listenAddr": {
                     "type": "string"
                 },
+                "logBuffer": {
+                    "description": "LogBuffer is how many lines the json and syslog targets buffer before dropping lines. Default: 1024.",
+                    "type": "integer"
+                },
                 "logFile": {
                     "type": "string"
                 },
+                "logFormat": {
+                    "description": "LogFormat is the access log format: apache, json or logfmt. Default: apache.",
+                    "type": "string"
+                },
+                "logTarget": {
+                    "description": "LogTarget is where the access log goes: file, stdout, json, syslog, udp://host:port or tcp://host:port.\nDefault: file when log_file is set, otherwise stdout.",
+                    "type": "string"
+                },
                 "maxIdleConns": {
                     "type": "integer"
                 },
@@ -497,11 +1057,295 @@ const docTemplateapi = `{
                         "type": "string"
                     }
                 },
+                "proxyMode": {
+                    "description": "ProxyMode is the reverse proxy in front of /auth: nginx, traefik, caddy or haproxy. Default: nginx.",
+                    "type": "string"
+                },
+                "queries": {
+                    "description": "Queries overrides the built-in user and server queries (optional).",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/userinfo.QueryConfig"
+                        }
+                    ]
+                },
+                "rateLimit": {
+                    "description": "RateLimit throttles user auth requests per API key or user ID.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/webserver.RateLimitConfig"
+                        }
+                    ]
+                },
+                "readyTimeout": {
+                    "description": "ReadyTimeout is how long /readyz waits for a database ping. Default: 2s.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "shutdownTimeout": {
+                    "description": "ShutdownTimeout is how long in-flight requests are given to finish on shutdown. Default: 8s.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "sslMode": {
+                    "description": "SSLMode is the postgres sslmode connection parameter, ie. disable, require, verify-full.",
+                    "type": "string"
+                },
+                "staleMaxAge": {
+                    "description": "StaleMaxAge keeps valid users this long in a stale store that is served when the database fails. 0 disables.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "syslogTag": {
+                    "description": "SyslogTag is the syslog app name. Default: authproxy.",
+                    "type": "string"
+                },
+                "top": {
+                    "description": "Top tracks the most active user IDs and API keys for /stats/top and the authproxy_top_requests metric.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/webserver.TopConfig"
+                        }
+                    ]
+                },
+                "tracing": {
+                    "description": "Tracing exports OpenTelemetry spans for auth requests and backend queries.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/webserver.TracingConfig"
+                        }
+                    ]
+                },
                 "user": {
                     "type": "string"
                 }
             }
         },
+        "webserver.KeyRule": {
+            "type": "object",
+            "properties": {
+                "format": {
+                    "description": "Format is an optional regular expression a valid key must match in full.",
+                    "type": "string"
+                },
+                "header": {
+                    "description": "Header is the header name for the header type.",
+                    "type": "string"
+                },
+                "length": {
+                    "description": "Length is the exact length of a valid key. Default: 36. -1 allows any length.",
+                    "type": "integer"
+                },
+                "name": {
+                    "description": "Name is the metric label for this rule. Default: the type and its parameter, e.g. query:apikey.",
+                    "type": "string"
+                },
+                "param": {
+                    "description": "Param is the query parameter name for the query type.",
+                    "type": "string"
+                },
+                "regex": {
+                    "description": "Regex is matched against the request uri for the regex type. The first capture group is the key.",
+                    "type": "string"
+                },
+                "segment": {
+                    "description": "Segment is the path segment index for the path type. /api/v1/route/method/{key} is 5.",
+                    "type": "integer"
+                },
+                "type": {
+                    "description": "Type is one of header, bearer, basic_user, basic_password, query, path or regex.",
+                    "type": "string"
+                }
+            }
+        },
+        "webserver.RateLimit": {
+            "type": "object",
+            "properties": {
+                "burst": {
+                    "description": "Burst is the bucket size. Default: Requests.",
+                    "type": "integer"
+                },
+                "by": {
+                    "description": "By is key or user. Default: key.",
+                    "type": "string"
+                },
+                "environment": {
+                    "description": "Environment only applies this limit to users in this environment. Empty matches every environment.",
+                    "type": "string"
+                },
+                "name": {
+                    "description": "Name is the metric label for this limit. Default: by, environment and path prefix, e.g. key:live:/api.",
+                    "type": "string"
+                },
+                "pathPrefix": {
+                    "description": "PathPrefix only applies this limit to request uris with this prefix. Empty matches every path.",
+                    "type": "string"
+                },
+                "per": {
+                    "description": "Per is the duration Requests are allowed in. Default: 1m.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "requests": {
+                    "description": "Requests is the number of requests allowed every Per.",
+                    "type": "integer"
+                }
+            }
+        },
+        "webserver.RateLimitConfig": {
+            "type": "object",
+            "properties": {
+                "limits": {
+                    "description": "Limits that match a request are all applied. The request is throttled when any of them is exhausted.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/webserver.RateLimit"
+                    }
+                },
+                "status": {
+                    "description": "Status is the http status code returned for throttled requests. Default: 403, or 429 in the traefik\nand caddy proxy modes, which pass the auth response through to the client.\nNginx auth_request turns any status except 401 and 403 into a 500, so nginx proxy mode only allows those.",
+                    "type": "integer"
+                },
+                "tiers": {
+                    "description": "Tiers are limits applied to users with a matching rate_tier from the database.",
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/webserver.RateLimit"
+                    }
+                }
+            }
+        },
+        "webserver.TopConfig": {
+            "type": "object",
+            "properties": {
+                "capacity": {
+                    "description": "Capacity is how many counters each slot keeps. More is more accurate. Default: 100, or 10x Size if that is more.",
+                    "type": "integer"
+                },
+                "size": {
+                    "description": "Size is how many user IDs and keys are reported per window. Default: 10.",
+                    "type": "integer"
+                },
+                "slot": {
+                    "description": "Slot is the window granularity. Windows slide by this much. Default: 1m.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ]
+                },
+                "windows": {
+                    "description": "Windows are the durations reported, rounded up to a multiple of Slot. Default: 1m, 15m and 1h.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/time.Duration"
+                    }
+                }
+            }
+        },
+        "webserver.TopEntry": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "description": "Error is how much Requests may be overcounted by.",
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "requests": {
+                    "type": "integer"
+                }
+            }
+        },
+        "webserver.TopWindow": {
+            "type": "object",
+            "properties": {
+                "keys": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/webserver.TopEntry"
+                    }
+                },
+                "users": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/webserver.TopEntry"
+                    }
+                },
+                "window": {
+                    "type": "string"
+                }
+            }
+        },
+        "webserver.TracingConfig": {
+            "type": "object",
+            "properties": {
+                "endpoint": {
+                    "description": "Endpoint is the collector: host:port for grpc, or a URL for http. Empty disables tracing.",
+                    "type": "string"
+                },
+                "insecure": {
+                    "description": "Insecure disables TLS to the collector.",
+                    "type": "boolean"
+                },
+                "protocol": {
+                    "description": "Protocol is grpc or http. Default: grpc.",
+                    "type": "string"
+                },
+                "sampleRatio": {
+                    "description": "SampleRatio is the fraction of new traces to record, from 0 to 1. Default: 1.\nTraces continued from a traceparent follow the parent's sampling decision.",
+                    "type": "number"
+                },
+                "serviceName": {
+                    "description": "ServiceName is the service.name resource attribute. Default: authproxy.",
+                    "type": "string"
+                }
+            }
+        },
+        "webserver.healthCheck": {
+            "type": "object",
+            "properties": {
+                "elapsed": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "ok": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "webserver.healthReply": {
+            "type": "object",
+            "properties": {
+                "checks": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/webserver.healthCheck"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                },
+                "uptime": {
+                    "type": "string"
+                }
+            }
+        },
         "webserver.noExists": {
             "type": "object",
             "properties": {
@@ -2,15 +2,25 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/proxyconf"
 	"github.com/Notifiarr/mysql-auth-proxy/pkg/webserver"
 )
 
 const defaultConfigFile = "/config/proxy.conf"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "example" {
+		exampleConfig(os.Args[2:])
+		return
+	}
+
 	configFile := os.Getenv("AP_CONFIG_FILE")
 	if configFile == "" {
 		configFile = defaultConfigFile
@@ -21,8 +31,33 @@ func main() {
 		log.Fatalf("ERROR: %v", err)
 	}
 
-	err = webserver.Start(cnfg)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		stop() // a second signal kills the app without waiting for the shutdown.
+	}()
+
+	err = webserver.Start(ctx, cnfg)
 	if err != nil {
+		log.Fatalf("ERROR: %v", err) //nolint:gocritic // stop() is only a signal reset.
+	}
+}
+
+// exampleConfig prints an example reverse proxy config: authproxy example <proxy> [auth proxy host:port].
+func exampleConfig(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: %s example <%s> [auth proxy host:port, default: %s]",
+			os.Args[0], strings.Join(proxyconf.Proxies(), "|"), proxyconf.DefaultAddr)
+	}
+
+	var addr string
+	if len(args) > 1 {
+		addr = args[1]
+	}
+
+	if err := proxyconf.Write(os.Stdout, args[0], addr); err != nil {
 		log.Fatalf("ERROR: %v", err)
 	}
 }
@@ -14,16 +14,28 @@ import (
 // CacheList is a map of label to stats functions for each cache.
 type CacheList map[string]func() *cache.Stats
 
+// TopCount is the approximate request count for one of the most active user IDs or API keys in a window.
+type TopCount struct {
+	Kind     string // user or key.
+	Window   string
+	ID       string
+	Requests uint64
+}
+
 // CacheCollector is our input for creating metrics for our cache data.
 type CacheCollector struct {
-	Stats   CacheList
+	Stats CacheList
+	// Top returns the most active user IDs and keys for authproxy_top_requests. Optional.
+	Top     func() []TopCount
 	counter *prometheus.Desc
 	gauge   *prometheus.Desc
+	top     *prometheus.Desc
 }
 
 // Describe satisfies the Collector interface for prometheus.
 func (c *CacheCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.counter
+	ch <- c.top
 }
 
 // Collect satisfies the Collector interface for prometheus.
@@ -42,6 +54,14 @@ func (c *CacheCollector) Collect(metrics chan<- prometheus.Metric) {
 		metrics <- prometheus.MustNewConstMetric(c.counter, prometheus.CounterValue, float64(cache.Prunes), label, "prunes")
 		metrics <- prometheus.MustNewConstMetric(c.counter, prometheus.CounterValue, float64(cache.Pruning.Nanoseconds()), label, "pruning")
 	}
+
+	if c.Top == nil {
+		return
+	}
+
+	for _, top := range c.Top() {
+		metrics <- prometheus.MustNewConstMetric(c.top, prometheus.GaugeValue, float64(top.Requests), top.Kind, top.Window, top.ID)
+	}
 }
 
 // HTTP request event labels for authproxy_http_requests_total (see warmHTTPMetrics).
@@ -52,6 +72,28 @@ const (
 	HTTPEventInvalidKey = "invalid_key"
 )
 
+// Auth decision result labels for authproxy_auth_decisions_total.
+const (
+	DecisionAllowed    = "allowed"      // a valid user or server.
+	DecisionDenied     = "denied"       // no valid user on a path that requires one, or rate limited.
+	DecisionNoAuthPath = "no-auth-path" // no valid user, on a path that does not require one.
+	DecisionDBError    = "db-error"     // the database failed and no stale user was available.
+)
+
+// Auth decision source labels for authproxy_auth_decisions_total.
+const (
+	SourceCache = "cache" // served from the users or servers cache.
+	SourceDB    = "db"    // looked up in the database.
+	SourceStale = "stale" // served from the stale store because the database failed.
+	SourceNone  = "none"  // no valid api key was found in the request.
+)
+
+// Admin rejection reason labels for authproxy_admin_rejected_total.
+const (
+	AdminRejectNetwork     = "network"
+	AdminRejectCredentials = "credentials"
+)
+
 // Metrics contains the exported prometheus metrics used by the application.
 type Metrics struct {
 	QueryErrors  *prometheus.CounterVec
@@ -61,6 +103,26 @@ type Metrics struct {
 	Uptime       prometheus.CounterFunc
 	HTTPRequests *prometheus.CounterVec
 	HTTPResponse *prometheus.CounterVec
+	AdminRejects *prometheus.CounterVec
+	Deduplicated *prometheus.CounterVec
+	StaleServes  *prometheus.CounterVec
+	// CircuitState is the database circuit breaker state: 0 closed, 1 open, 2 half-open.
+	CircuitState   prometheus.Gauge
+	CircuitRejects *prometheus.CounterVec
+	// Per database host metrics.
+	HostQueryTime   *prometheus.HistogramVec
+	HostQueryErrors *prometheus.CounterVec
+	HostUp          *prometheus.GaugeVec
+	// KeyRules counts which API key extraction rule found the key; "none" when no rule did.
+	KeyRules *prometheus.CounterVec
+	// RateLimited counts throttled auth requests by the rate limit that throttled them.
+	RateLimited *prometheus.CounterVec
+	// AuthDecisions counts auth outcomes by cache, result, user environment and source.
+	AuthDecisions *prometheus.CounterVec
+	// CacheAge is the age of the user or server data when it is served.
+	CacheAge *prometheus.HistogramVec
+	// LogDropped counts log lines dropped because a buffered log target could not keep up.
+	LogDropped *prometheus.CounterVec
 }
 
 // GetMetrics sets up metrics on startup.
@@ -69,11 +131,14 @@ type Metrics struct {
 // @Tags         stats
 // @Produce      json
 // @Success      200  {object} any "Auth Proxy Prometheus metrics"
+// @Failure      401  {object} string "invalid request"
 // @Router       /metrics [get]
 func GetMetrics(collector *CacheCollector) *Metrics {
 	start := time.Now()
 	collector.counter = prometheus.NewDesc("authproxy_cache_counters", "All cache counters", []string{"cache", "counter"}, nil)
 	collector.gauge = prometheus.NewDesc("authproxy_cache_gauges", "All cache gauges", []string{"cache", "gauge"}, nil)
+	collector.top = prometheus.NewDesc("authproxy_top_requests",
+		"Approximate auth requests in the window by the most active user IDs and keys", []string{"kind", "window", "id"}, nil)
 	prometheus.MustRegister(collector)
 
 	metrics := &Metrics{
@@ -107,6 +172,60 @@ func GetMetrics(collector *CacheCollector) *Metrics {
 			Name: "authproxy_http_responses_total",
 			Help: "HTTP responses by status code",
 		}, []string{"status_code"}),
+		AdminRejects: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_admin_rejected_total",
+			Help: "Admin endpoint requests rejected by reason",
+		}, []string{"reason"}),
+		Deduplicated: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_lookups_deduplicated_total",
+			Help: "Cache misses that waited on an in-flight lookup for the same key instead of querying",
+		}, []string{"cache"}),
+		StaleServes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_stale_serves_total",
+			Help: "Stale cached users served because the database lookup failed",
+		}, []string{"cache"}),
+		CircuitState: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "authproxy_db_circuit_state",
+			Help: "Database circuit breaker state: 0 closed, 1 open, 2 half-open",
+		}),
+		CircuitRejects: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_db_circuit_rejected_total",
+			Help: "Database lookups rejected because the circuit breaker is open",
+		}, []string{"cache"}),
+		HostQueryTime: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "authproxy_db_host_query_time_seconds",
+			Help:    "The duration of database queries per host",
+			Buckets: []float64{0.001, 0.005, 0.025, .1, .5, 1, 3},
+		}, []string{"host"}),
+		HostQueryErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_db_host_query_errors_total",
+			Help: "The total number of DB query errors per host",
+		}, []string{"host"}),
+		HostUp: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "authproxy_db_host_up",
+			Help: "Database host health: 1 up, 0 marked down",
+		}, []string{"host"}),
+		KeyRules: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_key_rule_matches_total",
+			Help: "Auth requests by the API key extraction rule that found the key",
+		}, []string{"rule"}),
+		RateLimited: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_rate_limited_total",
+			Help: "Auth requests throttled by the rate limiter, by limit",
+		}, []string{"limit"}),
+		AuthDecisions: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_auth_decisions_total",
+			Help: "Auth decisions by cache, result, environment and source",
+		}, []string{"cache", "result", "environment", "source"}),
+		CacheAge: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "authproxy_cache_age_seconds",
+			Help:    "The age of cached user and server data when it is served",
+			Buckets: []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+		}, []string{"cache", "source"}),
+		LogDropped: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_log_dropped_total",
+			Help: "Log lines dropped because the log target was too slow, by log",
+		}, []string{"log"}),
 	}
 
 	warmHTTPMetrics(metrics)
@@ -121,6 +240,13 @@ func warmHTTPMetrics(metrics *Metrics) {
 		metrics.QueryMissing.WithLabelValues(cache)
 		metrics.QueryTime.WithLabelValues(cache)
 		metrics.ReqTime.WithLabelValues(cache)
+		metrics.Deduplicated.WithLabelValues(cache)
+		metrics.StaleServes.WithLabelValues(cache)
+		metrics.CircuitRejects.WithLabelValues(cache)
+
+		for _, source := range []string{SourceCache, SourceDB, SourceStale} {
+			metrics.CacheAge.WithLabelValues(cache, source)
+		}
 	}
 
 	for _, event := range []string{
@@ -132,13 +258,19 @@ func warmHTTPMetrics(metrics *Metrics) {
 		metrics.HTTPRequests.WithLabelValues(event)
 	}
 
+	for _, reason := range []string{AdminRejectNetwork, AdminRejectCredentials} {
+		metrics.AdminRejects.WithLabelValues(reason)
+	}
+
 	for _, code := range []int{
 		http.StatusOK,
 		http.StatusUnauthorized,
+		http.StatusForbidden,
 		http.StatusNotFound,
 		http.StatusInternalServerError,
 		http.StatusBadRequest,
 		http.StatusMethodNotAllowed,
+		http.StatusTooManyRequests,
 	} {
 		metrics.HTTPResponse.WithLabelValues(strconv.Itoa(code))
 	}
@@ -162,3 +294,112 @@ func (m *Metrics) CountRequest(req *http.Request, statusCode string) {
 
 	m.HTTPResponse.WithLabelValues(statusCode).Inc()
 }
+
+// CountKeyRule increments the API key rule counter for the rule that found the key.
+func (m *Metrics) CountKeyRule(rule string) {
+	if m == nil {
+		return
+	}
+
+	m.KeyRules.WithLabelValues(rule).Inc()
+}
+
+// CountRateLimited increments the throttled request counter for a rate limit.
+func (m *Metrics) CountRateLimited(limit string) {
+	if m == nil {
+		return
+	}
+
+	m.RateLimited.WithLabelValues(limit).Inc()
+}
+
+// CountLogDropped increments the dropped log line counter for a log.
+func (m *Metrics) CountLogDropped(log string) {
+	if m == nil {
+		return
+	}
+
+	m.LogDropped.WithLabelValues(log).Inc()
+}
+
+// CountDecision increments the auth decision counter and records the age of the served data.
+// Requests without a valid api key have no data, so no age is recorded for them.
+func (m *Metrics) CountDecision(cache, result, environment, source string, age time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.AuthDecisions.WithLabelValues(cache, result, environment, source).Inc()
+
+	if source != SourceNone {
+		m.CacheAge.WithLabelValues(cache, source).Observe(age.Seconds())
+	}
+}
+
+// CountCheck increments the HTTP request and response metrics for an Envoy ext_authz check.
+func (m *Metrics) CountCheck(xServer bool, statusCode string) {
+	if m == nil {
+		return
+	}
+
+	m.HTTPRequests.WithLabelValues(HTTPEventTotal).Inc()
+
+	if xServer {
+		m.HTTPRequests.WithLabelValues(HTTPEventXServer).Inc()
+	}
+
+	m.HTTPResponse.WithLabelValues(statusCode).Inc()
+}
+
+// CountAdminReject increments the admin rejection counter for the provided reason.
+func (m *Metrics) CountAdminReject(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.AdminRejects.WithLabelValues(reason).Inc()
+}
+
+// SetCircuitState sets the database circuit breaker state gauge.
+func (m *Metrics) SetCircuitState(state int) {
+	if m == nil {
+		return
+	}
+
+	m.CircuitState.Set(float64(state))
+}
+
+// CountCircuitReject increments the counter for lookups rejected by an open circuit breaker.
+func (m *Metrics) CountCircuitReject(cache string) {
+	if m == nil {
+		return
+	}
+
+	m.CircuitRejects.WithLabelValues(cache).Inc()
+}
+
+// ObserveHostQuery records a query's duration and error for a database host.
+func (m *Metrics) ObserveHostQuery(host string, seconds float64, failed bool) {
+	if m == nil {
+		return
+	}
+
+	m.HostQueryTime.WithLabelValues(host).Observe(seconds)
+
+	if failed {
+		m.HostQueryErrors.WithLabelValues(host).Inc()
+	}
+}
+
+// SetHostUp sets the health gauge for a database host.
+func (m *Metrics) SetHostUp(host string, up bool) {
+	if m == nil {
+		return
+	}
+
+	if up {
+		m.HostUp.WithLabelValues(host).Set(1)
+	} else {
+		m.HostUp.WithLabelValues(host).Set(0)
+	}
+}
@@ -0,0 +1,65 @@
+// Package proxyconf generates example reverse proxy configs that use the auth proxy.
+package proxyconf
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"text/template"
+)
+
+// DefaultAddr is the auth proxy address used in the examples when none is provided.
+const DefaultAddr = "127.0.0.1:8080"
+
+// ErrUnknownProxy is returned when there is no example for the requested proxy.
+var ErrUnknownProxy = errors.New("no example config for proxy")
+
+//go:embed examples
+var examples embed.FS
+
+// files maps proxy names to their example config file.
+//
+//nolint:gochecknoglobals // read-only lookup table.
+var files = map[string]string{
+	"nginx":   "examples/nginx.conf",
+	"traefik": "examples/traefik.yml",
+	"caddy":   "examples/Caddyfile",
+	"haproxy": "examples/haproxy.cfg",
+}
+
+// Proxies returns the names of the proxies with example configs, sorted.
+func Proxies() []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// Write writes the example config for proxy to output. addr is the auth proxy's host:port.
+func Write(output io.Writer, proxy, addr string) error {
+	file, ok := files[proxy]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownProxy, proxy)
+	}
+
+	if addr == "" {
+		addr = DefaultAddr
+	}
+
+	tmpl, err := template.ParseFS(examples, file)
+	if err != nil {
+		return fmt.Errorf("parsing example: %w", err)
+	}
+
+	if err = tmpl.Execute(output, map[string]string{"Addr": addr}); err != nil {
+		return fmt.Errorf("writing example: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package proxyconf_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/proxyconf"
+)
+
+func TestWrite(t *testing.T) {
+	t.Parallel()
+
+	for _, proxy := range proxyconf.Proxies() {
+		var buf bytes.Buffer
+		if err := proxyconf.Write(&buf, proxy, "auth:9090"); err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+
+		if !strings.Contains(buf.String(), "auth:9090") || strings.Contains(buf.String(), "{{") {
+			t.Fatalf("%s: address not rendered:\n%s", proxy, buf.String())
+		}
+	}
+}
+
+func TestWrite_unknownProxy(t *testing.T) {
+	t.Parallel()
+
+	if err := proxyconf.Write(&bytes.Buffer{}, "apache", ""); !errors.Is(err, proxyconf.ErrUnknownProxy) {
+		t.Fatalf("err = %v, want ErrUnknownProxy", err)
+	}
+}
@@ -0,0 +1,190 @@
+package userinfo
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+)
+
+// BreakerConfig configures the circuit breaker around database lookups.
+// The breaker opens after Errors consecutive failed lookups, and lookups fail fast while it is open.
+// After Cooldown it half-opens and lets one probe lookup through at a time;
+// Probes successful probes close it again, and a failed probe re-opens it.
+type BreakerConfig struct {
+	// Errors is the number of consecutive failures that open the breaker. 0 disables the breaker.
+	Errors int `json:"errors" toml:"errors" xml:"errors"`
+	// Latency counts lookups slower than this as failures. 0 disables the latency threshold.
+	Latency time.Duration `json:"latency,omitempty" toml:"latency" xml:"latency"`
+	// Cooldown is how long the breaker stays open before probing. Default: 10s.
+	Cooldown time.Duration `json:"cooldown,omitempty" toml:"cooldown" xml:"cooldown"`
+	// Probes is the number of successful probes required to close the breaker. Default: 1.
+	Probes int `json:"probes,omitempty" toml:"probes" xml:"probes"`
+}
+
+// Circuit breaker states, exported as the authproxy_db_circuit_state gauge.
+const (
+	CircuitClosed = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+const defaultBreakerCooldown = 10 * time.Second
+
+// ErrCircuitOpen is returned by lookups while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("database circuit breaker is open")
+
+// breaker wraps a Backend with a circuit breaker. Ping and Close pass through.
+type breaker struct {
+	Backend
+
+	logger    *log.Logger
+	config    BreakerConfig
+	metrics   *exp.Metrics
+	now       func() time.Time
+	mu        sync.Mutex
+	state     int
+	failures  int       // consecutive failures while closed.
+	successes int       // successful probes while half-open.
+	probing   bool      // a probe is in flight while half-open.
+	openedAt  time.Time // when the breaker last opened.
+}
+
+var _ Backend = (*breaker)(nil)
+
+// newBreaker wraps a backend with a circuit breaker.
+func newBreaker(backend Backend, config *BreakerConfig, metrics *exp.Metrics, logger *log.Logger) *breaker {
+	brk := &breaker{
+		Backend: backend,
+		logger:  logger,
+		config:  *config,
+		metrics: metrics,
+		now:     time.Now,
+	}
+
+	if brk.config.Cooldown <= 0 {
+		brk.config.Cooldown = defaultBreakerCooldown
+	}
+
+	if brk.config.Probes <= 0 {
+		brk.config.Probes = 1
+	}
+
+	if brk.logger == nil {
+		brk.logger = log.Default()
+	}
+
+	metrics.SetCircuitState(CircuitClosed)
+
+	return brk
+}
+
+// GetInfo looks up a user through the circuit breaker.
+func (b *breaker) GetInfo(ctx context.Context, requestKey string) (*UserInfo, error) {
+	return b.do("users", func() (*UserInfo, error) { return b.Backend.GetInfo(ctx, requestKey) })
+}
+
+// GetServer looks up a server through the circuit breaker.
+func (b *breaker) GetServer(ctx context.Context, serverID string) (*UserInfo, error) {
+	return b.do("servers", func() (*UserInfo, error) { return b.Backend.GetServer(ctx, serverID) })
+}
+
+func (b *breaker) do(label string, lookup func() (*UserInfo, error)) (*UserInfo, error) {
+	if !b.allow() {
+		b.metrics.CountCircuitReject(label)
+		return nil, ErrCircuitOpen
+	}
+
+	start := b.now()
+	user, err := lookup()
+	b.done(err, b.now().Sub(start))
+
+	return user, err
+}
+
+// allow returns true if a lookup may run. While half-open only one probe runs at a time.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.config.Cooldown {
+			return false
+		}
+
+		b.setState(CircuitHalfOpen)
+
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+
+		return true
+	default:
+		return true
+	}
+}
+
+// done records the outcome of a lookup.
+func (b *breaker) done(err error, elapsed time.Duration) {
+	// A missing user is a successful query.
+	failed := (err != nil && !errors.Is(err, ErrNoUser)) || (b.config.Latency > 0 && elapsed > b.config.Latency)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case errors.Is(err, context.Canceled): // not the database's fault, and not a success either.
+		b.probing = false
+	case b.state == CircuitHalfOpen && failed:
+		b.probing = false
+		b.open()
+	case b.state == CircuitHalfOpen:
+		b.probing = false
+
+		if b.successes++; b.successes >= b.config.Probes {
+			b.failures = 0
+			b.setState(CircuitClosed)
+		}
+	case failed:
+		if b.failures++; b.state == CircuitClosed && b.failures >= b.config.Errors {
+			b.open()
+		}
+	default:
+		b.failures = 0
+	}
+}
+
+// open opens the breaker. Caller must hold b.mu.
+func (b *breaker) open() {
+	b.openedAt = b.now()
+	b.setState(CircuitOpen)
+}
+
+// setState changes the breaker state, logs it and updates the gauge. Caller must hold b.mu.
+func (b *breaker) setState(state int) {
+	if b.state == state {
+		return
+	}
+
+	b.state = state
+	b.successes = 0
+	b.metrics.SetCircuitState(state)
+
+	switch state {
+	case CircuitOpen:
+		b.logger.Printf("[ERROR] Database circuit breaker opened after %d failures, retrying in %v",
+			b.failures, b.config.Cooldown)
+	case CircuitHalfOpen:
+		b.logger.Printf("[WARNING] Database circuit breaker half-open, probing")
+	case CircuitClosed:
+		b.logger.Printf("Database circuit breaker closed")
+	}
+}
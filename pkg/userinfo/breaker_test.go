@@ -0,0 +1,140 @@
+//nolint:testpackage // Tests the unexported circuit breaker.
+package userinfo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+var errTestDB = errors.New("database is down")
+
+// breakerTestBackend returns err from every lookup.
+type breakerTestBackend struct {
+	err   error
+	calls int
+}
+
+func (b *breakerTestBackend) GetInfo(context.Context, string) (*UserInfo, error) {
+	b.calls++
+	return DefaultUser(), b.err
+}
+
+func (b *breakerTestBackend) GetServer(context.Context, string) (*UserInfo, error) {
+	b.calls++
+	return DefaultUser(), b.err
+}
+
+func (b *breakerTestBackend) Ping(context.Context) error { return b.err }
+func (b *breakerTestBackend) Close() error               { return nil }
+
+func newTestBreaker(backend Backend, config *BreakerConfig) (*breaker, *time.Time) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	brk := newBreaker(backend, config, nil, log.New(io.Discard, "", 0))
+	brk.now = func() time.Time { return now }
+
+	return brk, &now
+}
+
+func TestBreaker_opensAndRecovers(t *testing.T) {
+	t.Parallel()
+
+	backend := &breakerTestBackend{err: errTestDB}
+	brk, now := newTestBreaker(backend, &BreakerConfig{Errors: 3, Cooldown: time.Minute})
+
+	for range 3 {
+		if _, err := brk.GetInfo(t.Context(), "key"); !errors.Is(err, errTestDB) {
+			t.Fatalf("closed breaker err = %v, want %v", err, errTestDB)
+		}
+	}
+
+	if _, err := brk.GetServer(t.Context(), "srv"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("open breaker err = %v, want %v", err, ErrCircuitOpen)
+	}
+
+	if backend.calls != 3 {
+		t.Fatalf("backend calls = %d, want 3", backend.calls)
+	}
+
+	// Failed probe re-opens the breaker.
+	*now = now.Add(time.Minute)
+	if _, err := brk.GetInfo(t.Context(), "key"); !errors.Is(err, errTestDB) {
+		t.Fatalf("probe err = %v, want %v", err, errTestDB)
+	}
+
+	if brk.state != CircuitOpen {
+		t.Fatalf("state after failed probe = %d, want open", brk.state)
+	}
+
+	// Successful probe closes it.
+	backend.err = ErrNoUser
+	*now = now.Add(time.Minute)
+
+	if _, err := brk.GetInfo(t.Context(), "key"); !errors.Is(err, ErrNoUser) {
+		t.Fatalf("probe err = %v, want %v", err, ErrNoUser)
+	}
+
+	if brk.state != CircuitClosed {
+		t.Fatalf("state after good probe = %d, want closed", brk.state)
+	}
+}
+
+func TestBreaker_halfOpenAllowsOneProbe(t *testing.T) {
+	t.Parallel()
+
+	brk, now := newTestBreaker(&breakerTestBackend{}, &BreakerConfig{Errors: 1, Probes: 2})
+	brk.done(errTestDB, 0)
+
+	if brk.allow() {
+		t.Fatal("open breaker allowed a lookup during cooldown")
+	}
+
+	*now = now.Add(defaultBreakerCooldown)
+
+	if !brk.allow() {
+		t.Fatal("half-open breaker did not allow a probe")
+	}
+
+	if brk.allow() {
+		t.Fatal("half-open breaker allowed a second concurrent probe")
+	}
+
+	brk.done(nil, 0)
+
+	if brk.state != CircuitHalfOpen {
+		t.Fatalf("state after 1 of 2 probes = %d, want half-open", brk.state)
+	}
+
+	if !brk.allow() {
+		t.Fatal("half-open breaker did not allow the next probe")
+	}
+
+	brk.done(nil, 0)
+
+	if brk.state != CircuitClosed {
+		t.Fatalf("state after 2 probes = %d, want closed", brk.state)
+	}
+}
+
+func TestBreaker_latency(t *testing.T) {
+	t.Parallel()
+
+	brk, _ := newTestBreaker(&breakerTestBackend{}, &BreakerConfig{Errors: 2, Latency: time.Second})
+
+	brk.done(nil, 2*time.Second)
+	brk.done(nil, time.Millisecond) // resets consecutive failures.
+	brk.done(nil, 2*time.Second)
+
+	if brk.state != CircuitClosed {
+		t.Fatalf("state = %d, want closed", brk.state)
+	}
+
+	brk.done(nil, 2*time.Second)
+
+	if brk.state != CircuitOpen {
+		t.Fatalf("state = %d, want open", brk.state)
+	}
+}
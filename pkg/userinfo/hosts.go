@@ -0,0 +1,220 @@
+package userinfo
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Database host roles.
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	healthCheckTimeout    = 5 * time.Second
+)
+
+// ErrUnknownRole is returned when a host role is not primary or replica.
+var ErrUnknownRole = errors.New("unknown database host role")
+
+// HostConfig is one database host. Lookups are spread across healthy replicas,
+// and fall back to the primary hosts when no replica is healthy.
+type HostConfig struct {
+	Host string `json:"host" toml:"host" xml:"host"`
+	// Role is primary or replica. Default: primary.
+	Role string `json:"role" toml:"role" xml:"role"`
+}
+
+// dbHost is a connection pool to one database host.
+type dbHost struct {
+	name    string
+	replica bool
+	dbase   *sql.DB
+	healthy atomic.Bool
+}
+
+// hostConfigs returns the configured hosts with their roles validated, or the single Host as a primary.
+func (c *Config) hostConfigs() ([]HostConfig, error) {
+	if len(c.Hosts) == 0 {
+		return []HostConfig{{Host: c.Host, Role: RolePrimary}}, nil
+	}
+
+	configs := make([]HostConfig, len(c.Hosts))
+
+	for idx, host := range c.Hosts {
+		switch host.Role = strings.ToLower(host.Role); host.Role {
+		case "":
+			host.Role = RolePrimary
+		case RolePrimary, RoleReplica:
+		default:
+			return nil, fmt.Errorf("%w: %s: %q, must be %s or %s", ErrUnknownRole, host.Host, host.Role, RolePrimary, RoleReplica)
+		}
+
+		configs[idx] = host
+	}
+
+	return configs, nil
+}
+
+// openHosts opens a connection pool for every configured host.
+func (u *UI) openHosts() ([]*dbHost, error) {
+	configs, err := u.config.hostConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]*dbHost, 0, len(configs))
+
+	for _, hostConfig := range configs {
+		config := *u.config
+		config.Host = hostConfig.Host
+
+		dbase, err := sql.Open(u.dialect.driver, u.dialect.dsn(&config))
+		if err != nil {
+			closeHosts(hosts)
+			return nil, fmt.Errorf("%s server %s: connecting: %w", u.dialect.driver, hostConfig.Host, err)
+		}
+
+		u.applyPoolSettings(dbase)
+
+		host := &dbHost{name: hostConfig.Host, replica: hostConfig.Role == RoleReplica, dbase: dbase}
+		host.healthy.Store(true)
+		u.metrics.SetHostUp(host.name, true)
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+func closeHosts(hosts []*dbHost) {
+	for _, host := range hosts {
+		_ = host.dbase.Close()
+	}
+}
+
+// pick returns the hosts to try, in order: healthy replicas (rotated per call),
+// then healthy primaries, then every unhealthy host as a last resort.
+func (u *UI) pick() []*dbHost {
+	if len(u.hosts) == 1 {
+		return u.hosts
+	}
+
+	var replicas, primaries, unhealthy []*dbHost
+
+	for _, host := range u.hosts {
+		switch {
+		case !host.healthy.Load():
+			unhealthy = append(unhealthy, host)
+		case host.replica:
+			replicas = append(replicas, host)
+		default:
+			primaries = append(primaries, host)
+		}
+	}
+
+	if len(replicas) > 1 {
+		next := int(u.next.Add(1) % uint64(len(replicas))) //nolint:gosec // len is never negative.
+		replicas = append(replicas[next:], replicas[:next]...)
+	}
+
+	return slices.Concat(replicas, primaries, unhealthy)
+}
+
+// query runs a lookup query, failing over to the next host on connection errors.
+// The query time metric covers the whole lookup, failovers included. Each host's attempts
+// are observed in the per-host metrics.
+func (u *UI) query(ctx context.Context, label string, qry *query, value string) (*sql.Rows, error) {
+	lookup := time.Now()
+	defer func() { u.metrics.QueryTime.WithLabelValues(label).Observe(time.Since(lookup).Seconds()) }()
+
+	var lastErr error
+
+	for _, host := range u.pick() {
+		start := time.Now()
+		rows, err := host.dbase.QueryContext(ctx, qry.sql, qry.values(value)...)
+		u.metrics.ObserveHostQuery(host.name, time.Since(start).Seconds(), err != nil)
+
+		if err == nil {
+			return rows, nil
+		}
+
+		lastErr = fmt.Errorf("%s: %w", host.name, err)
+
+		if ctx.Err() != nil || !isConnError(err) {
+			break
+		}
+
+		u.markDown(host, err)
+	}
+
+	return nil, lastErr
+}
+
+// markDown marks a host unhealthy so it is skipped until the health check finds it again.
+// A lone host is never marked down: there is nothing to fail over to, and no health check to bring it back.
+func (u *UI) markDown(host *dbHost, err error) {
+	if len(u.hosts) > 1 && host.healthy.Swap(false) {
+		u.metrics.SetHostUp(host.name, false)
+		u.Printf("[ERROR] Database host %s marked down: %v", host.name, err)
+	}
+}
+
+// healthCheck re-checks unhealthy hosts until ctx is cancelled.
+func (u *UI) healthCheck(ctx context.Context, hosts []*dbHost) {
+	interval := u.config.HealthInterval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, host := range hosts {
+				if host.healthy.Load() {
+					continue
+				}
+
+				pingCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+				err := host.dbase.PingContext(pingCtx)
+
+				cancel()
+
+				if err == nil && !host.healthy.Swap(true) {
+					u.metrics.SetHostUp(host.name, true)
+					u.Printf("Database host %s is back up", host.name)
+				}
+			}
+		}
+	}
+}
+
+// isConnError returns true for errors that mean the host is unreachable,
+// as opposed to a bad query or a missing row.
+func isConnError(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr)
+}
@@ -0,0 +1,157 @@
+//nolint:testpackage // Tests unexported host selection.
+package userinfo
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// downDriver is a database/sql driver for a host that refuses every connection.
+type downDriver struct{}
+
+func (downDriver) Open(string) (driver.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+}
+
+func init() { //nolint:gochecknoinits // drivers can only be registered once.
+	sql.Register("userinfo-test-down", downDriver{})
+}
+
+// sampleCount returns the number of observations in a histogram.
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil { //nolint:forcetypeassert // histograms are metrics.
+		t.Fatalf("reading histogram: %v", err)
+	}
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func testHosts(names ...string) []*dbHost {
+	hosts := make([]*dbHost, len(names))
+
+	for idx, name := range names {
+		hosts[idx] = &dbHost{name: name, replica: name[0] == 'r'}
+		hosts[idx].healthy.Store(true)
+	}
+
+	return hosts
+}
+
+func hostNames(hosts []*dbHost) string {
+	names := ""
+	for _, host := range hosts {
+		names += host.name + " "
+	}
+
+	return names
+}
+
+func TestPick(t *testing.T) {
+	t.Parallel()
+
+	info := &UI{hosts: testHosts("primary", "replica1", "replica2")}
+
+	first, second := hostNames(info.pick()), hostNames(info.pick())
+	if first == second {
+		t.Fatalf("replicas were not rotated: %q, %q", first, second)
+	}
+
+	for _, order := range []string{first, second} {
+		if order != "replica2 replica1 primary " && order != "replica1 replica2 primary " {
+			t.Fatalf("unexpected host order: %q", order)
+		}
+	}
+
+	info.hosts[1].healthy.Store(false)
+	info.hosts[2].healthy.Store(false)
+
+	if order := hostNames(info.pick()); order != "primary replica1 replica2 " {
+		t.Fatalf("unhealthy replicas must be tried last, got: %q", order)
+	}
+}
+
+func TestMarkDown_loneHost(t *testing.T) {
+	t.Parallel()
+
+	info := &UI{hosts: testHosts("primary")}
+	info.markDown(info.hosts[0], errors.New("connection refused"))
+
+	if !info.hosts[0].healthy.Load() {
+		t.Fatal("a lone host must not be marked down, nothing would bring it back up")
+	}
+}
+
+func TestQuery_failoverMetrics(t *testing.T) {
+	t.Parallel()
+
+	info := &UI{Logger: log.New(io.Discard, "", 0), hosts: testHosts("primary-down", "replica-down")}
+	info.metrics = exp.GetMetrics(&exp.CacheCollector{Stats: exp.CacheList{}})
+
+	for _, host := range info.hosts {
+		host.dbase, _ = sql.Open("userinfo-test-down", host.name)
+		t.Cleanup(func() { _ = host.dbase.Close() })
+	}
+
+	lookups := sampleCount(t, info.metrics.QueryTime.WithLabelValues("users"))
+
+	if _, err := info.query(context.Background(), "users", &query{sql: "SELECT 1"}, "key"); !isConnError(err) {
+		t.Fatalf("err = %v, want a connection error", err)
+	}
+
+	// One lookup is one query time sample, however many hosts it tried.
+	if got := sampleCount(t, info.metrics.QueryTime.WithLabelValues("users")) - lookups; got != 1 {
+		t.Fatalf("query time observed %d times for one lookup, want 1", got)
+	}
+
+	for _, host := range info.hosts {
+		if got := sampleCount(t, info.metrics.HostQueryTime.WithLabelValues(host.name)); got != 1 {
+			t.Errorf("%s: host query time observed %d times, want 1", host.name, got)
+		}
+	}
+}
+
+func TestHostConfigs(t *testing.T) {
+	t.Parallel()
+
+	config := &Config{Hosts: []HostConfig{{Host: "db1"}, {Host: "db2", Role: "Replica"}}}
+
+	hosts, err := config.hostConfigs()
+	if err != nil || hosts[0].Role != RolePrimary || hosts[1].Role != RoleReplica {
+		t.Fatalf("roles: %+v, %v", hosts, err)
+	}
+
+	config.Hosts[1].Role = "secondary"
+	if _, err := config.hostConfigs(); !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("err = %v, want ErrUnknownRole", err)
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	t.Parallel()
+
+	for err, want := range map[error]bool{
+		&net.OpError{Op: "dial", Err: errors.New("refused")}:  true,
+		fmt.Errorf("wrapped: %w", context.DeadlineExceeded):   true, // context.DeadlineExceeded is a net.Error.
+		errors.New("Error 1146: Table 'users' doesn't exist"): false,
+		ErrNoUser: false,
+	} {
+		if got := isConnError(err); got != want {
+			t.Errorf("isConnError(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package userinfo
+
+import (
+	"strings"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+	_ "github.com/go-sql-driver/mysql" // We use mysql driver, this is how it's loaded.
+)
+
+const getUserQuery = "SELECT `developmentEnv`,`environment`,`name`,`id` FROM `users` WHERE `apikey`= ? " +
+	"OR `id` = (SELECT `user_id` FROM `apikeys` WHERE `apikey`= ? LIMIT 1) LIMIT 1"
+
+const getServerQuery = "SELECT `apikey`,`developmentEnv`,`environment`,`name`,`id`,`discordServer` " +
+	"FROM `users` WHERE `discordServer` = ?"
+
+// NewMySQL returns a MySQL user info Backend.
+func NewMySQL(config *Config, metrics *exp.Metrics) (*UI, error) {
+	return newSQL(config, metrics, &dialect{
+		driver:      DriverMySQL,
+		dsn:         mysqlDSN,
+		userQuery:   getUserQuery,
+		serverQuery: getServerQuery,
+	})
+}
+
+// mysqlDSN returns a go-sql-driver connection string. Hosts starting with @ are used as-is, ie. @unix(/path).
+func mysqlDSN(config *Config) string {
+	host := "@tcp(" + config.Host + ")"
+	if strings.HasPrefix(config.Host, "@") {
+		host = config.Host
+	}
+
+	return config.User + ":" + config.Pass + host + "/" + config.Name
+}
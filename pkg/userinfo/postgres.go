@@ -0,0 +1,50 @@
+package userinfo
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+	_ "github.com/lib/pq" // Postgres driver, registered as "postgres".
+)
+
+const getUserQueryPostgres = `SELECT "developmentEnv","environment","name","id" FROM "users" WHERE "apikey" = $1 ` +
+	`OR "id" = (SELECT "user_id" FROM "apikeys" WHERE "apikey" = $2 LIMIT 1) LIMIT 1`
+
+const getServerQueryPostgres = `SELECT "apikey","developmentEnv","environment","name","id","discordServer" ` +
+	`FROM "users" WHERE "discordServer" = $1`
+
+// NewPostgres returns a PostgreSQL user info Backend.
+// It uses the same users and apikeys schema as the MySQL Backend.
+func NewPostgres(config *Config, metrics *exp.Metrics) (*UI, error) {
+	return newSQL(config, metrics, &dialect{
+		driver:      DriverPostgres,
+		dsn:         postgresDSN,
+		userQuery:   getUserQueryPostgres,
+		serverQuery: getServerQueryPostgres,
+	})
+}
+
+// postgresDSN returns a lib/pq connection URL. Hosts starting with / are unix socket directories.
+func postgresDSN(config *Config) string {
+	dsn := &url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(config.User, config.Pass),
+		Path:   "/" + config.Name,
+	}
+	query := url.Values{}
+
+	if strings.HasPrefix(config.Host, "/") {
+		query.Set("host", config.Host)
+	} else {
+		dsn.Host = config.Host
+	}
+
+	if config.SSLMode != "" {
+		query.Set("sslmode", config.SSLMode)
+	}
+
+	dsn.RawQuery = query.Encode()
+
+	return dsn.String()
+}
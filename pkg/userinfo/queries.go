@@ -0,0 +1,260 @@
+package userinfo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Column names used to map query results onto UserInfo fields.
+const (
+	ColumnAPIKey      = "api_key"     // UserInfo.APIKey.
+	ColumnDevEnv      = "dev_env"     // environment is only used when this is 1 or true.
+	ColumnEnvironment = "environment" // UserInfo.Environment.
+	ColumnUsername    = "username"    // UserInfo.Username.
+	ColumnUserID      = "user_id"     // UserInfo.UserID.
+	ColumnRateTier    = "rate_tier"   // UserInfo.RateTier.
+	ColumnRateLimit   = "rate_limit"  // UserInfo.RateLimit, a number of requests.
+	ColumnRatePeriod  = "rate_period" // UserInfo.RatePeriod, in seconds.
+	ColumnIgnore      = "-"           // selected column is not used.
+)
+
+// QueryConfig overrides the built-in queries so the proxy can be pointed at another schema.
+// Every placeholder in a query is given the same value: the api key or the server id.
+// The columns lists map each selected column, in order, onto a UserInfo field.
+// Valid column names are api_key, dev_env, environment, username, user_id,
+// rate_tier, rate_limit, rate_period and - (ignored).
+// When dev_env is not selected, the environment column is used as-is.
+type QueryConfig struct {
+	User          string   `json:"user,omitempty"          toml:"user"           xml:"user"`
+	UserColumns   []string `json:"userColumns,omitempty"   toml:"user_columns"   xml:"user_column"`
+	Server        string   `json:"server,omitempty"        toml:"server"         xml:"server"`
+	ServerColumns []string `json:"serverColumns,omitempty" toml:"server_columns" xml:"server_column"`
+}
+
+// Errors returned when validating custom queries.
+var (
+	ErrUnknownColumn = errors.New("unknown column mapping")
+	ErrNoUserID      = errors.New("column mapping must include user_id")
+	ErrNoColumns     = errors.New("custom query requires a column mapping")
+)
+
+// query is a lookup query and the mapping of its result columns onto UserInfo.
+type query struct {
+	sql     string
+	columns []string  // UserInfo field for each selected column.
+	args    int       // number of placeholders, each given the lookup value.
+	devEnv  bool      // true if a dev_env column is selected.
+	buffers sync.Pool // *scanBuffer, sized for columns.
+}
+
+// scanBuffer holds the scan destinations for one row, reused across lookups.
+type scanBuffer struct {
+	values []sql.NullString
+	dest   []any
+}
+
+const prepareTimeout = 10 * time.Second
+
+// newQuery validates a column mapping and counts the placeholders in a query.
+func newQuery(driver, sqlQuery string, columns []string) (*query, error) {
+	if len(columns) == 0 {
+		return nil, ErrNoColumns
+	}
+
+	qry := &query{sql: sqlQuery, columns: columns, args: countPlaceholders(driver, sqlQuery)}
+	qry.buffers.New = func() any {
+		buf := &scanBuffer{values: make([]sql.NullString, len(columns)), dest: make([]any, len(columns))}
+		for idx := range buf.values {
+			buf.dest[idx] = &buf.values[idx]
+		}
+
+		return buf
+	}
+
+	hasUserID := false
+
+	for _, column := range columns {
+		switch column {
+		case ColumnDevEnv:
+			qry.devEnv = true
+		case ColumnUserID:
+			hasUserID = true
+		case ColumnAPIKey, ColumnEnvironment, ColumnUsername, ColumnIgnore,
+			ColumnRateTier, ColumnRateLimit, ColumnRatePeriod:
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownColumn, column)
+		}
+	}
+
+	if !hasUserID {
+		return nil, ErrNoUserID
+	}
+
+	return qry, nil
+}
+
+// setQueries builds the user and server queries from the dialect defaults and any configured overrides.
+func (u *UI) setQueries() error {
+	var err error
+
+	custom := u.config.Queries
+	if custom == nil {
+		custom = &QueryConfig{}
+	}
+
+	userSQL, userCols := u.dialect.userQuery, []string{ColumnDevEnv, ColumnEnvironment, ColumnUsername, ColumnUserID}
+	if custom.User != "" {
+		userSQL, userCols = custom.User, custom.UserColumns
+	}
+
+	if u.users, err = newQuery(u.dialect.driver, userSQL, userCols); err != nil {
+		return fmt.Errorf("user query: %w", err)
+	}
+
+	serverSQL, serverCols := u.dialect.serverQuery, []string{
+		ColumnAPIKey, ColumnDevEnv, ColumnEnvironment, ColumnUsername, ColumnUserID, ColumnIgnore,
+	}
+	if custom.Server != "" {
+		serverSQL, serverCols = custom.Server, custom.ServerColumns
+	}
+
+	if u.servers, err = newQuery(u.dialect.driver, serverSQL, serverCols); err != nil {
+		return fmt.Errorf("server query: %w", err)
+	}
+
+	return nil
+}
+
+// prepareQueries does a dry-run PREPARE of both queries to validate them against the database.
+func (u *UI) prepareQueries(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, prepareTimeout)
+	defer cancel()
+
+	for name, qry := range map[string]*query{"user": u.users, "server": u.servers} {
+		stmt, err := u.pick()[0].dbase.PrepareContext(ctx, qry.sql)
+		if err != nil {
+			return fmt.Errorf("preparing %s query: %w", name, err)
+		}
+
+		_ = stmt.Close()
+	}
+
+	return nil
+}
+
+// values returns the query arguments: the lookup value once per placeholder.
+func (q *query) values(value string) []any {
+	args := make([]any, q.args)
+	for idx := range args {
+		args[idx] = value
+	}
+
+	return args
+}
+
+// scan reads the current row into user using the column mapping.
+// NullString copies the row's bytes, so the buffer is safe to reuse once scan returns.
+func (q *query) scan(rows *sql.Rows, user *UserInfo) error {
+	buf, _ := q.buffers.Get().(*scanBuffer)
+	defer q.buffers.Put(buf)
+
+	values := buf.values
+
+	if err := rows.Scan(buf.dest...); err != nil {
+		return fmt.Errorf("scanning database row: %w", err)
+	}
+
+	devAllowed := !q.devEnv
+
+	for idx, column := range q.columns {
+		if !values[idx].Valid {
+			continue
+		}
+
+		switch column {
+		case ColumnAPIKey:
+			user.APIKey = values[idx].String
+		case ColumnDevEnv:
+			devAllowed = devEnvAllowed(values[idx].String)
+		case ColumnEnvironment:
+			user.Environment = values[idx].String
+		case ColumnUsername:
+			user.Username = values[idx].String
+		case ColumnUserID:
+			user.UserID = values[idx].String
+		case ColumnRateTier:
+			user.RateTier = values[idx].String
+		case ColumnRateLimit:
+			user.RateLimit, _ = strconv.Atoi(values[idx].String) // not a number is no quota.
+		case ColumnRatePeriod:
+			user.RatePeriod, _ = strconv.Atoi(values[idx].String)
+		}
+	}
+
+	if !devAllowed || user.Environment == "" {
+		user.Environment = DefaultEnvironment
+	}
+
+	return nil
+}
+
+// countPlaceholders returns the number of bind arguments a query needs.
+// MySQL counts each ? and postgres uses the highest $N. Quoted strings, identifiers and comments are skipped.
+// Backslash escapes a quote in MySQL strings, and in postgres E'...' strings.
+func countPlaceholders(driver, sqlQuery string) int { //nolint:cyclop
+	var (
+		count   int
+		quote   byte
+		escapes bool // backslash escapes the next character in the current quote.
+	)
+
+	postgres := driver == DriverPostgres
+
+	for idx := 0; idx < len(sqlQuery); idx++ {
+		char := sqlQuery[idx]
+		rest := sqlQuery[idx:]
+
+		switch {
+		case quote != 0:
+			if escapes && char == '\\' {
+				idx++
+			} else if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+			escapes = char != '`' && (!postgres || (char == '\'' && idx > 0 && (sqlQuery[idx-1] == 'E' || sqlQuery[idx-1] == 'e')))
+		case strings.HasPrefix(rest, "--") || (!postgres && char == '#'):
+			if end := strings.IndexByte(rest, '\n'); end >= 0 {
+				idx += end
+			} else {
+				idx = len(sqlQuery)
+			}
+		case strings.HasPrefix(rest, "/*"):
+			if end := strings.Index(rest[2:], "*/"); end >= 0 {
+				idx += end + 3 //nolint:mnd // the comment and its end.
+			} else {
+				idx = len(sqlQuery)
+			}
+		case postgres && char == '$':
+			num := 0
+
+			for idx+1 < len(sqlQuery) && sqlQuery[idx+1] >= '0' && sqlQuery[idx+1] <= '9' {
+				idx++
+				num = num*10 + int(sqlQuery[idx]-'0') //nolint:mnd
+			}
+
+			count = max(count, num)
+		case !postgres && char == '?':
+			count++
+		}
+	}
+
+	return count
+}
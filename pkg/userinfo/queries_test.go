@@ -0,0 +1,73 @@
+//nolint:testpackage // Tests unexported query helpers.
+package userinfo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCountPlaceholders(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		driver, query string
+		want          int
+	}{
+		{DriverMySQL, getUserQuery, 2},
+		{DriverMySQL, getServerQuery, 1},
+		{DriverPostgres, getUserQueryPostgres, 2},
+		{DriverPostgres, getServerQueryPostgres, 1},
+		{DriverMySQL, "SELECT '?', `a?` FROM t WHERE k = ?", 1},
+		{DriverPostgres, `SELECT '$9' FROM t WHERE a = $1 OR b = $1 OR c = $3`, 3},
+		{DriverMySQL, "SELECT 1", 0},
+		{DriverMySQL, `SELECT 'it\'s?' FROM t WHERE k = ?`, 1},
+		{DriverMySQL, "SELECT a -- why?\nFROM t # who?\nWHERE k = ? /* and ? */ AND j = ?", 2},
+		{DriverPostgres, `SELECT E'\'$2' FROM t WHERE a = $1 -- or $3`, 1},
+		{DriverPostgres, `SELECT 'a\' FROM t WHERE a = $1 /* $4 */`, 1},
+	}
+
+	for _, testCase := range cases {
+		if got := countPlaceholders(testCase.driver, testCase.query); got != testCase.want {
+			t.Errorf("countPlaceholders(%s, %q) = %d, want %d", testCase.driver, testCase.query, got, testCase.want)
+		}
+	}
+}
+
+func TestSetQueries(t *testing.T) {
+	t.Parallel()
+
+	info := &UI{config: &Config{}, dialect: &dialect{driver: DriverMySQL, userQuery: getUserQuery, serverQuery: getServerQuery}}
+	if err := info.setQueries(); err != nil {
+		t.Fatalf("default queries: %v", err)
+	}
+
+	if info.users.args != 2 || !info.users.devEnv {
+		t.Fatalf("default user query args = %d, devEnv = %v", info.users.args, info.users.devEnv)
+	}
+
+	info.config.Queries = &QueryConfig{
+		User:        "SELECT uid, uname, plan, quota FROM accounts WHERE token = ?",
+		UserColumns: []string{ColumnUserID, ColumnUsername, ColumnRateTier, ColumnRateLimit},
+	}
+	if err := info.setQueries(); err != nil {
+		t.Fatalf("custom user query: %v", err)
+	}
+
+	if info.users.args != 1 || info.users.devEnv || len(info.servers.columns) != 6 {
+		t.Fatalf("custom user query args = %d, devEnv = %v", info.users.args, info.users.devEnv)
+	}
+
+	for name, test := range map[string]struct {
+		config *QueryConfig
+		err    error
+	}{
+		"no columns":     {&QueryConfig{User: "SELECT 1"}, ErrNoColumns},
+		"unknown column": {&QueryConfig{User: "SELECT 1", UserColumns: []string{"user_id", "email"}}, ErrUnknownColumn},
+		"no user id":     {&QueryConfig{Server: "SELECT 1", ServerColumns: []string{"username"}}, ErrNoUserID},
+	} {
+		info.config.Queries = test.config
+		if err := info.setQueries(); !errors.Is(err, test.err) {
+			t.Errorf("%s: err = %v, want %v", name, err, test.err)
+		}
+	}
+}
@@ -1,22 +1,14 @@
-// Package userinfo contains the methods to get Notifiarr user and server information from mysql.
+// Package userinfo contains the methods to get Notifiarr user and server information from mysql or postgres.
 package userinfo
 
 import (
 	"context"
 	"fmt"
-	"time"
 )
 
-const getServerQuery = "SELECT `apikey`,`developmentEnv`,`environment`,`name`,`id`,`discordServer` " +
-	"FROM `users` WHERE `discordServer` = ?"
-
 // GetServer retrieves a Discord server's information from the database.
 func (u *UI) GetServer(ctx context.Context, serverID string) (*UserInfo, error) {
-	start := time.Now()
-
-	rows, err := u.dbase.QueryContext(ctx, getServerQuery, serverID)
-	u.metrics.QueryTime.WithLabelValues("servers").Observe(time.Since(start).Seconds())
-
+	rows, err := u.query(ctx, "servers", u.servers, serverID)
 	if err != nil {
 		u.metrics.QueryErrors.WithLabelValues("servers").Inc()
 		return nil, fmt.Errorf("querying database: %w", err)
@@ -26,21 +18,15 @@ func (u *UI) GetServer(ctx context.Context, serverID string) (*UserInfo, error)
 
 	for rows.Next() {
 		user := DefaultUser()
-		devAllowed := "0"
-		discord := ""
 
-		err := rows.Scan(&user.APIKey, &devAllowed, &user.Environment, &user.Username, &user.UserID, &discord)
+		err := u.servers.scan(rows, user)
 		if err != nil {
-			u.Printf("[ERROR] scanning mysql rows: %v", err)
+			u.Printf("[ERROR] scanning %s rows: %v", u.dialect.driver, err)
 			u.metrics.QueryErrors.WithLabelValues("servers").Inc()
 
 			continue
 		}
 
-		if devAllowed != "1" {
-			user.Environment = DefaultEnvironment
-		}
-
 		return user, nil
 	}
 
@@ -0,0 +1,170 @@
+package userinfo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+)
+
+// UI is the SQL Backend. It queries a mysql or postgres database for user info.
+type UI struct {
+	*log.Logger
+
+	config  *Config
+	dialect *dialect
+	users   *query
+	servers *query
+	hosts   []*dbHost
+	next    atomic.Uint64      // rotates lookups across replicas.
+	stop    context.CancelFunc // stops the health check.
+	metrics *exp.Metrics
+}
+
+// dialect contains the driver-specific parts of the SQL Backend.
+type dialect struct {
+	driver      string               // database/sql driver name.
+	dsn         func(*Config) string // builds the connection string.
+	userQuery   string               // default user query.
+	serverQuery string               // default server query.
+}
+
+var _ Backend = (*UI)(nil)
+
+// newSQL returns a SQL user info Backend for the provided dialect.
+func newSQL(config *Config, metrics *exp.Metrics, dialect *dialect) (*UI, error) {
+	if config == nil {
+		return nil, ErrNoConfig
+	}
+
+	info := &UI{
+		metrics: metrics,
+		config:  config,
+		dialect: dialect,
+		Logger:  config.Logger,
+	}
+
+	if info.Logger == nil {
+		info.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if err := info.setQueries(); err != nil {
+		return nil, err
+	}
+
+	if err := info.Open(); err != nil {
+		return nil, err
+	}
+
+	if config.Queries == nil {
+		return info, nil
+	}
+
+	return info, info.prepareQueries(context.Background())
+}
+
+// Open a database connection to every configured host.
+// With more than one host, unhealthy hosts are re-checked in the background.
+func (u *UI) Open() error {
+	if u.hosts != nil {
+		_ = u.Close()
+	}
+
+	hosts, err := u.openHosts()
+	if err != nil {
+		return err
+	}
+
+	u.hosts = hosts
+	u.stop = func() {}
+
+	if len(hosts) > 1 {
+		var ctx context.Context
+
+		ctx, u.stop = context.WithCancel(context.Background())
+		go u.healthCheck(ctx, hosts)
+	}
+
+	return nil
+}
+
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 25
+	defaultConnMaxLifetime = 5 * time.Minute
+	defaultConnMaxIdleTime = 90 * time.Second
+)
+
+// applyPoolSettings applies the pool settings to the database connection.
+func (u *UI) applyPoolSettings(dbase *sql.DB) {
+	maxOpen := u.config.MaxOpenConns
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenConns
+	}
+
+	maxIdle := u.config.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+
+	lifetime := u.config.ConnMaxLifetime
+	if lifetime <= 0 {
+		lifetime = defaultConnMaxLifetime
+	}
+
+	idleTime := u.config.ConnMaxIdleTime
+	if idleTime <= 0 {
+		idleTime = defaultConnMaxIdleTime
+	}
+
+	dbase.SetMaxOpenConns(maxOpen)
+	dbase.SetMaxIdleConns(maxIdle)
+	dbase.SetConnMaxLifetime(lifetime)
+	dbase.SetConnMaxIdleTime(idleTime)
+}
+
+// Ping checks that at least one database host is reachable.
+func (u *UI) Ping(ctx context.Context) error {
+	var err error
+
+	for _, host := range u.pick() {
+		if err = host.dbase.PingContext(ctx); err == nil {
+			return nil
+		}
+
+		err = fmt.Errorf("%s: %w", host.name, err)
+	}
+
+	return fmt.Errorf("pinging database: %w", err)
+}
+
+// Close the database connections.
+func (u *UI) Close() error {
+	u.stop()
+
+	var errs []error
+
+	for _, host := range u.hosts {
+		if err := host.dbase.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host.name, err))
+		}
+	}
+
+	u.hosts = nil
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("closing database: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+//nolint:testpackage // Tests unexported connection string builders.
+package userinfo
+
+import "testing"
+
+func TestMySQLDSN(t *testing.T) {
+	t.Parallel()
+
+	config := &Config{Host: "mysql:3306", User: "proxy", Pass: "pass", Name: "notifiarr"}
+	if got, want := mysqlDSN(config), "proxy:pass@tcp(mysql:3306)/notifiarr"; got != want {
+		t.Fatalf("mysqlDSN = %q, want %q", got, want)
+	}
+
+	config.Host = "@unix(/run/mysqld/mysqld.sock)"
+	if got, want := mysqlDSN(config), "proxy:pass@unix(/run/mysqld/mysqld.sock)/notifiarr"; got != want {
+		t.Fatalf("mysqlDSN = %q, want %q", got, want)
+	}
+}
+
+func TestPostgresDSN(t *testing.T) {
+	t.Parallel()
+
+	config := &Config{Host: "pg:5432", User: "proxy", Pass: "p@ss", Name: "notifiarr", SSLMode: "disable"}
+	if got, want := postgresDSN(config), "postgres://proxy:p%40ss@pg:5432/notifiarr?sslmode=disable"; got != want {
+		t.Fatalf("postgresDSN = %q, want %q", got, want)
+	}
+
+	config = &Config{Host: "/var/run/postgresql", User: "proxy", Name: "notifiarr"}
+	if got, want := postgresDSN(config), "postgres://proxy:@/notifiarr?host=%2Fvar%2Frun%2Fpostgresql"; got != want {
+		t.Fatalf("postgresDSN = %q, want %q", got, want)
+	}
+}
+
+func TestDevEnvAllowed(t *testing.T) {
+	t.Parallel()
+
+	for value, want := range map[string]bool{"1": true, "true": true, "t": true, "0": false, "false": false, "": false} {
+		if got := devEnvAllowed(value); got != want {
+			t.Errorf("devEnvAllowed(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -1,16 +1,14 @@
 package userinfo
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
-	_ "github.com/go-sql-driver/mysql" // We use mysql driver, this is how it's loaded.
 )
 
 // Default user values.
@@ -20,28 +18,51 @@ const (
 	DefaultUserID      = "-1"
 )
 
-// Config to get user data from the mysql database.
+// Drivers that may be selected in Config.
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+)
+
+// Config to get user data from the mysql or postgres database.
 type Config struct {
 	*log.Logger `json:"-"`
 
-	Host string `json:"host" toml:"host" xml:"host"`
-	User string `json:"user" toml:"user" xml:"user"`
-	Pass string `json:"-"    toml:"pass" xml:"pass"`
-	Name string `json:"name" toml:"name" xml:"name"`
+	// Driver selects the Backend implementation. Defaults to mysql.
+	Driver string `json:"driver,omitempty" toml:"driver" xml:"driver"`
+	Host   string `json:"host"             toml:"host"   xml:"host"`
+	User   string `json:"user"             toml:"user"   xml:"user"`
+	Pass   string `json:"-"                toml:"pass"   xml:"pass"`
+	Name   string `json:"name"             toml:"name"   xml:"name"`
+	// SSLMode is the postgres sslmode connection parameter, ie. disable, require, verify-full.
+	SSLMode string `json:"sslMode,omitempty" toml:"ssl_mode" xml:"ssl_mode"`
 	// Pool tuning (optional). Zero values use defaults suitable for high-throughput auth lookups.
 	MaxOpenConns    int           `json:"maxOpenConns,omitempty"    toml:"max_open_conns"     xml:"max_open_conns"`
 	MaxIdleConns    int           `json:"maxIdleConns,omitempty"    toml:"max_idle_conns"     xml:"max_idle_conns"`
 	ConnMaxLifetime time.Duration `json:"connMaxLifetime,omitempty" toml:"conn_max_lifetime"  xml:"conn_max_lifetime"`
 	ConnMaxIdleTime time.Duration `json:"connMaxIdleTime,omitempty" toml:"conn_max_idle_time" xml:"conn_max_idle_time"`
+	// Hosts lists database hosts and their roles (optional). When empty, Host is the only (primary) host.
+	Hosts []HostConfig `json:"hosts,omitempty" toml:"hosts" xml:"hosts"`
+	// HealthInterval is how often hosts marked down are re-checked. Default: 30s.
+	HealthInterval time.Duration `json:"healthInterval,omitempty" toml:"health_interval" xml:"health_interval"`
+	// Queries overrides the built-in user and server queries (optional).
+	Queries *QueryConfig `json:"queries,omitempty" toml:"queries" xml:"queries"`
+	// Breaker wraps database lookups with a circuit breaker (optional).
+	Breaker *BreakerConfig `json:"breaker,omitempty" toml:"breaker" xml:"breaker"`
 }
 
-// UI provides an interface to query a database for user info.
-type UI struct {
-	*log.Logger
-
-	config  *Config
-	dbase   *sql.DB
-	metrics *exp.Metrics
+// Backend looks up users and Discord servers in a data store.
+type Backend interface {
+	// GetInfo returns a user's info for an API key.
+	// A default user and ErrNoUser are returned when the key does not exist.
+	GetInfo(ctx context.Context, requestKey string) (*UserInfo, error)
+	// GetServer returns the info for the user that owns a Discord server.
+	// A default user is returned when the server does not exist.
+	GetServer(ctx context.Context, serverID string) (*UserInfo, error)
+	// Ping checks the backend is reachable.
+	Ping(ctx context.Context) error
+	// Close releases the backend's resources.
+	Close() error
 }
 
 // UserInfo is the data returned for each user request.
@@ -50,97 +71,59 @@ type UserInfo struct {
 	Environment string `json:"environment"`
 	Username    string `json:"username"`
 	UserID      string `json:"userId"`
+	// RateTier is the user's rate limit tier. The tiers are configured in the proxy.
+	RateTier string `json:"rateTier,omitempty"`
+	// RateLimit is the user's own quota: RateLimit requests every RatePeriod seconds.
+	RateLimit  int `json:"rateLimit,omitempty"`
+	RatePeriod int `json:"ratePeriod,omitempty"`
+	// Cached is when a user restored from a cache snapshot was originally cached.
+	// The cache records the restore time instead. Zero for users from the backend.
+	Cached time.Time `json:"-"`
 }
 
 // Errors returned by this package.
 var (
-	ErrNoConfig = errors.New("config must contain all fields")
-	ErrNoUser   = errors.New("user not found")
+	ErrNoConfig      = errors.New("config must contain all fields")
+	ErrNoUser        = errors.New("user not found")
+	ErrUnknownDriver = errors.New("unknown user info driver")
 )
 
-// New returns a User Info interface.
-func New(config *Config, metrics *exp.Metrics) (*UI, error) {
+// New returns the user info Backend selected by the Driver in config.
+func New(config *Config, metrics *exp.Metrics) (Backend, error) {
 	if config == nil {
 		return nil, ErrNoConfig
 	}
 
-	info := &UI{
-		metrics: metrics,
-		config:  config,
-		Logger:  config.Logger,
+	var (
+		backend Backend
+		err     error
+	)
+
+	switch strings.ToLower(config.Driver) {
+	case "", DriverMySQL:
+		backend, err = NewMySQL(config, metrics)
+	case DriverPostgres, "postgresql", "pgsql":
+		backend, err = NewPostgres(config, metrics)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDriver, config.Driver)
 	}
 
-	if info.Logger == nil {
-		info.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	if err != nil || config.Breaker == nil || config.Breaker.Errors <= 0 {
+		return backend, err
 	}
 
-	return info, info.Open()
+	return newBreaker(backend, config.Breaker, metrics, config.Logger), nil
 }
 
-// Open a mysql database connection.
-func (u *UI) Open() error {
-	if u.dbase != nil {
-		_ = u.dbase.Close()
-	}
-
-	host := "@tcp(" + u.config.Host + ")"
-	if strings.HasPrefix(u.config.Host, "@") {
-		host = u.config.Host
-	}
-
-	dbase, err := sql.Open("mysql", u.config.User+":"+u.config.Pass+host+"/"+u.config.Name)
-	if err != nil {
-		return fmt.Errorf("mysql server %s: connecting: %w", u.config.Host, err)
+// devEnvAllowed returns true if the developmentEnv column allows a non-default environment.
+// MySQL returns "1" for a tinyint, and postgres returns "true" for a boolean.
+func devEnvAllowed(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "t", "true":
+		return true
+	default:
+		return false
 	}
-
-	u.applyPoolSettings(dbase)
-	u.dbase = dbase
-
-	return nil
-}
-
-const (
-	defaultMaxOpenConns    = 25
-	defaultMaxIdleConns    = 25
-	defaultConnMaxLifetime = 5 * time.Minute
-	defaultConnMaxIdleTime = 90 * time.Second
-)
-
-// applyPoolSettings applies the pool settings to the database connection.
-func (u *UI) applyPoolSettings(dbase *sql.DB) {
-	maxOpen := u.config.MaxOpenConns
-	if maxOpen <= 0 {
-		maxOpen = defaultMaxOpenConns
-	}
-
-	maxIdle := u.config.MaxIdleConns
-	if maxIdle <= 0 {
-		maxIdle = defaultMaxIdleConns
-	}
-
-	if maxIdle > maxOpen {
-		maxIdle = maxOpen
-	}
-
-	lifetime := u.config.ConnMaxLifetime
-	if lifetime <= 0 {
-		lifetime = defaultConnMaxLifetime
-	}
-
-	idleTime := u.config.ConnMaxIdleTime
-	if idleTime <= 0 {
-		idleTime = defaultConnMaxIdleTime
-	}
-
-	dbase.SetMaxOpenConns(maxOpen)
-	dbase.SetMaxIdleConns(maxIdle)
-	dbase.SetConnMaxLifetime(lifetime)
-	dbase.SetConnMaxIdleTime(idleTime)
-}
-
-// Close the database connection.
-func (u *UI) Close() {
-	_ = u.dbase.Close()
 }
 
 // DefaultUser returns a new user with default values (safe to mutate, e.g. set APIKey).
@@ -3,19 +3,11 @@ package userinfo
 import (
 	"context"
 	"fmt"
-	"time"
 )
 
-const getUserQuery = "SELECT `developmentEnv`,`environment`,`name`,`id` FROM `users` WHERE `apikey`= ? " +
-	"OR `id` = (SELECT `user_id` FROM `apikeys` WHERE `apikey`= ? LIMIT 1) LIMIT 1"
-
-// GetInfo returns a user's info from a mysql database.
+// GetInfo returns a user's info from the database.
 func (u *UI) GetInfo(ctx context.Context, requestKey string) (*UserInfo, error) {
-	start := time.Now()
-
-	rows, err := u.dbase.QueryContext(ctx, getUserQuery, requestKey, requestKey)
-	u.metrics.QueryTime.WithLabelValues("users").Observe(time.Since(start).Seconds())
-
+	rows, err := u.query(ctx, "users", u.users, requestKey)
 	if err != nil {
 		u.metrics.QueryErrors.WithLabelValues("users").Inc()
 		return nil, fmt.Errorf("querying database: %w", err)
@@ -38,12 +30,10 @@ func (u *UI) GetInfo(ctx context.Context, requestKey string) (*UserInfo, error)
 		return user, ErrNoUser // must return default user on error.
 	}
 
-	devAllowed := "0"
-
-	err = rows.Scan(&devAllowed, &user.Environment, &user.Username, &user.UserID)
+	err = u.users.scan(rows, user)
 	if err != nil {
 		u.metrics.QueryErrors.WithLabelValues("users").Inc()
-		return nil, fmt.Errorf("scanning database rows: %w", err)
+		return nil, err
 	}
 
 	err = rows.Err()
@@ -52,9 +42,5 @@ func (u *UI) GetInfo(ctx context.Context, requestKey string) (*UserInfo, error)
 		u.Printf("[ERROR] iterating database rows (ignored): %v", err)
 	}
 
-	if devAllowed != "1" {
-		user.Environment = DefaultEnvironment
-	}
-
 	return user, nil
 }
@@ -1,6 +1,8 @@
 package webserver
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -14,6 +16,31 @@ import (
 
 const accessLogInitialGrow = 512
 
+// Access log formats.
+const (
+	LogFormatApache = "apache" // combined-style line with req:, age:, env:, key: and srv: suffixes.
+	LogFormatJSON   = "json"   // one JSON object per line.
+	LogFormatLogfmt = "logfmt" // one line of key=value pairs.
+)
+
+// ErrUnknownLogFormat is returned when log_format is not a supported format.
+var ErrUnknownLogFormat = errors.New("unknown log format")
+
+// checkLogFormat normalizes and validates the configured access log format.
+func (c *Config) checkLogFormat() error {
+	c.LogFormat = strings.ToLower(c.LogFormat)
+
+	switch c.LogFormat {
+	case "":
+		c.LogFormat = LogFormatApache
+	case LogFormatApache, LogFormatJSON, LogFormatLogfmt:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownLogFormat, c.LogFormat)
+	}
+
+	return nil
+}
+
 // captureWriter records status and body size for access logging.
 type captureWriter struct {
 	http.ResponseWriter
@@ -21,6 +48,11 @@ type captureWriter struct {
 	start  time.Time
 	status int
 	size   int64
+	// rules are the server's key rules. The referer path is truncated before any key they find.
+	rules []*keyRule
+	// logReq replaces the request in the access log. Forward auth handlers set it to the request
+	// with the original host and method, because middleware passes them a copy of the request.
+	logReq *http.Request
 }
 
 func (c *captureWriter) WriteHeader(code int) {
@@ -50,13 +82,24 @@ func (c *captureWriter) statusCode() string {
 	return strconv.Itoa(c.status)
 }
 
-// accessLogWrap writes one Apache-style line per request to dst (same field order as the former alFmt)
-// and records HTTP request/response Prometheus counters when metrics is non-nil.
-func (s *server) accessLogWrap(next http.Handler, dst io.Writer) http.Handler {
+// accessLogWrap writes one line per request to dst in the given format (apache if empty), and
+// records HTTP request/response Prometheus counters when metrics is non-nil.
+// The apache format keeps the same field order as the former alFmt.
+func (s *server) accessLogWrap(next http.Handler, dst io.Writer, format string) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		capture := &captureWriter{ResponseWriter: resp, start: time.Now()}
+		s.inflight.Add(1)
+		defer s.inflight.Done()
+
+		capture := &captureWriter{ResponseWriter: resp, start: time.Now(), rules: s.rules()}
 		next.ServeHTTP(capture, req)
-		capture.writeAccessLogLine(req, dst)
+
+		if capture.logReq != nil {
+			capture.writeAccessLogLine(capture.logReq, dst, format)
+		} else {
+			capture.writeAccessLogLine(req, dst, format)
+		}
+
+		s.requests.Add(1)
 		// Update Prometheus metrics for the request.
 		s.metrics.CountRequest(req, capture.statusCode())
 	})
@@ -65,15 +108,24 @@ func (s *server) accessLogWrap(next http.Handler, dst io.Writer) http.Handler {
 //nolint:gochecknoglobals // one pool per process for hot-path access log strings.Builder reuse
 var alBuilder = sync.Pool{New: func() any { return &strings.Builder{} }}
 
-func (c *captureWriter) writeAccessLogLine(req *http.Request, dst io.Writer) {
+func (c *captureWriter) writeAccessLogLine(req *http.Request, dst io.Writer, format string) {
 	//nolint:forcetypeassert
 	builder := alBuilder.Get().(*strings.Builder) // Get a string buffer:
 	builder.Reset()                               //  - reset it.
 	builder.Grow(accessLogInitialGrow)            //  - grow it.
-	c.writeAccessLogLinePrefix(builder, req)      //  - fill prefix.
-	c.writeAccessLogLineTail(builder, req)        //  - fill suffix.
-	_, _ = io.WriteString(dst, builder.String())  //  - write it.
-	alBuilder.Put(builder)                        //  - put it back.
+
+	switch format { //                               - fill it.
+	case LogFormatJSON:
+		c.writeAccessLogJSON(builder, req)
+	case LogFormatLogfmt:
+		c.writeAccessLogLogfmt(builder, req)
+	default:
+		c.writeAccessLogLinePrefix(builder, req)
+		c.writeAccessLogLineTail(builder, req)
+	}
+
+	_, _ = io.WriteString(dst, builder.String()) //  - write it.
+	alBuilder.Put(builder)                       //  - put it back.
 }
 
 func (c *captureWriter) writeAccessLogLinePrefix(builder *strings.Builder, req *http.Request) {
@@ -116,7 +168,7 @@ func (c *captureWriter) writeAccessLogLinePrefix(builder *strings.Builder, req *
 	builder.WriteByte(' ')
 	// "%{Referer}i" "%{User-agent}i" query:...
 	builder.WriteByte('"')
-	builder.WriteString(RefererPathForLog(req.Header))
+	builder.WriteString(redactedPath(c.rules, req.Header))
 	builder.WriteString("\" \"")
 	builder.WriteString(req.UserAgent())
 	builder.WriteByte('"')
@@ -161,28 +213,9 @@ func maskedAPIKeyForLog(req *http.Request, resp http.Header) (string, string) {
 // API key segment (keyPosition), using the same strings.Split(path, "/") rules as GetAPIKeyFromURIPath.
 // If the path has fewer than keyPosition+1 segments, it returns the full path (still without query).
 // When X-Original-Uri is missing, empty, or only a query string, it returns "".
+// The access log and traces use the configured key rules instead, see redactedPath.
 func RefererPathForLog(header http.Header) string {
-	pathPart, _, _ := strings.Cut(getHeader(header, HeaderXOriginalURI), "?")
-	if pathPart == "" {
-		return ""
-	}
-
-	var pos, segIdx int
-
-	for seg := range strings.SplitSeq(pathPart, "/") {
-		if segIdx == keyPosition {
-			return strings.TrimSuffix(pathPart[:pos], "/")
-		}
-
-		pos += len(seg)
-		if pos < len(pathPart) && pathPart[pos] == '/' {
-			pos++
-		}
-
-		segIdx++
-	}
-
-	return pathPart
+	return redactedPath(defaultKeyRules, header)
 }
 
 // ClientIPForLog returns the client IP for access logs (same rules as the former fixForwardedFor middleware).
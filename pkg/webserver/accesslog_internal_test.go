@@ -3,6 +3,8 @@ package webserver
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -217,7 +219,7 @@ func TestAccessLogWrap(t *testing.T) {
 		resp.Header().Set(HeaderAge, "3")
 		resp.Header().Set(HeaderEnvironment, "dev")
 		resp.WriteHeader(http.StatusNoContent)
-	}), &dst)
+	}), &dst, "")
 
 	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "http://proxy.test/auth", nil)
 	req.RequestURI = "/auth"
@@ -260,7 +262,7 @@ func TestAccessLogWrap_MaskedKeyFromResponseHeader(t *testing.T) {
 	handler := srv.accessLogWrap(http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
 		resp.Header().Set(HeaderXAPIKey, TestAccessLogAPIKey)
 		resp.WriteHeader(http.StatusUnauthorized)
-	}), &dst)
+	}), &dst, "")
 
 	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "http://h/", nil)
 	req.RemoteAddr = "127.0.0.1:1"
@@ -275,3 +277,115 @@ func TestAccessLogWrap_MaskedKeyFromResponseHeader(t *testing.T) {
 		t.Fatalf("expected masked key from X-Api-Key response header in log: %q", dst.String())
 	}
 }
+
+// structuredLogRequest returns a request and a captured response with every access log field set.
+func structuredLogRequest() (*http.Request, *captureWriter) {
+	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "http://example.com/auth", nil)
+	req.RequestURI = "/auth"
+	req.RemoteAddr = "192.0.2.1:9999"
+	req.Header.Set("User-Agent", `agent "quoted"/1`)
+	req.Header.Set(HeaderXServer, "srv-99")
+	req.Header.Set(HeaderXOriginalURI, "/api/v1/route/method/"+TestAccessLogAPIKey)
+
+	capWriter := &captureWriter{ResponseWriter: httptest.NewRecorder()}
+	capWriter.start = time.Now()
+	capWriter.Header().Set(HeaderXUsername, "alice smith")
+	capWriter.Header().Set(HeaderXUserid, "1001")
+	capWriter.Header().Set(HeaderAge, "60")
+	capWriter.Header().Set(HeaderEnvironment, "live")
+	capWriter.Header().Set(HeaderXAPIKey, TestAccessLogAPIKey)
+	capWriter.WriteHeader(http.StatusOK)
+
+	return req, capWriter
+}
+
+func TestWriteAccessLogLine_JSON(t *testing.T) {
+	t.Parallel()
+
+	var dst bytes.Buffer
+
+	req, capWriter := structuredLogRequest()
+	capWriter.writeAccessLogLine(req, &dst, LogFormatJSON)
+
+	var got map[string]any
+	if err := json.Unmarshal(dst.Bytes(), &got); err != nil {
+		t.Fatalf("invalid json: %v: %q", err, dst.String())
+	}
+
+	masked, _ := maskAPIKey(TestAccessLogAPIKey)
+	want := map[string]any{
+		"host": "example.com", "client_ip": "192.0.2.1", "username": "alice smith", "user_id": "1001",
+		"method": "GET", "uri": "/auth", "status": 200.0, "size": 0.0, "referer": "/api/v1/route/method",
+		"user_agent": `agent "quoted"/1`, "age": 60.0, "env": "live", "key": masked, "key_len": 36.0,
+		"server": "srv-99", "time": capWriter.start.Format(time.RFC3339),
+	}
+
+	for field, value := range want {
+		if got[field] != value {
+			t.Errorf("%s = %#v, want %#v", field, got[field], value)
+		}
+	}
+
+	if _, ok := got["duration_ms"].(float64); !ok || len(got) != accessLogFieldCount {
+		t.Errorf("unexpected fields: %v", got)
+	}
+}
+
+func TestWriteAccessLogLine_Logfmt(t *testing.T) {
+	t.Parallel()
+
+	var dst bytes.Buffer
+
+	req, capWriter := structuredLogRequest()
+	capWriter.Header().Del(HeaderAge)
+	capWriter.writeAccessLogLine(req, &dst, LogFormatLogfmt)
+
+	line := dst.String()
+	for _, want := range []string{
+		"time=" + capWriter.start.Format(time.RFC3339) + " host=example.com client_ip=192.0.2.1 ",
+		`username="alice smith" user_id=1001 method=GET uri=/auth status=200 size=0 referer=/api/v1/route/method `,
+		`user_agent="agent \"quoted\"/1" duration_ms=`,
+		` age= env=live key=aaaa...ee key_len=36 server=srv-99` + "\n",
+	} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("expected %q in logfmt line: %q", want, line)
+		}
+	}
+}
+
+func TestWriteQuoted(t *testing.T) {
+	t.Parallel()
+
+	for value, want := range map[string]string{
+		"":              `""`,
+		"plain":         `"plain"`,
+		"tab\tnl\n\x01": `"tab\tnl\n\u0001"`,
+		`back\slash"`:   `"back\\slash\""`,
+		"caf\xc3\xa9":   `"café"`,
+		"bad\xffutf8":   `"bad\ufffdutf8"`,
+	} {
+		builder := &strings.Builder{}
+		if writeQuoted(builder, value); builder.String() != want {
+			t.Errorf("writeQuoted(%q) = %s, want %s", value, builder.String(), want)
+		}
+	}
+}
+
+func TestCheckLogFormat(t *testing.T) {
+	t.Parallel()
+
+	config := &Config{LogFormat: "JSON"}
+	if err := config.checkLogFormat(); err != nil || config.LogFormat != LogFormatJSON {
+		t.Fatalf("JSON: %v, format %q", err, config.LogFormat)
+	}
+
+	config.LogFormat = ""
+	if err := config.checkLogFormat(); err != nil || config.LogFormat != LogFormatApache {
+		t.Fatalf("empty: %v, format %q, want apache", err, config.LogFormat)
+	}
+
+	config.LogFormat = "xml"
+	if err := config.checkLogFormat(); !errors.Is(err, ErrUnknownLogFormat) {
+		t.Fatalf("xml: err = %v, want ErrUnknownLogFormat", err)
+	}
+}
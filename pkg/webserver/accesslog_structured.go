@@ -0,0 +1,164 @@
+package webserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/* Structured (json and logfmt) access log lines, with the same fields as the apache format. */
+
+const accessLogFieldCount = 17
+
+// logField is one access log field. Number fields are written unquoted, and as null in json when empty.
+type logField struct {
+	name   string
+	value  string
+	number bool
+}
+
+// accessLogFields returns the access log fields in a fixed size array, so they stay on the stack.
+func (c *captureWriter) accessLogFields(req *http.Request) [accessLogFieldCount]logField {
+	respHeader := c.Header()
+	masked, keyLenStr := maskedAPIKeyForLog(req, respHeader)
+
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+
+	return [accessLogFieldCount]logField{
+		{name: "time", value: c.start.Format(time.RFC3339)},
+		{name: "host", value: req.Host},
+		{name: "client_ip", value: ClientIPForLog(req)},
+		{name: "username", value: getHeader(respHeader, HeaderXUsername)},
+		{name: "user_id", value: getHeader(respHeader, HeaderXUserid)},
+		{name: "method", value: req.Method},
+		{name: "uri", value: uri},
+		{name: "status", value: c.statusCode(), number: true},
+		{name: "size", value: strconv.FormatInt(c.size, 10), number: true},
+		{name: "referer", value: redactedPath(c.rules, req.Header)},
+		{name: "user_agent", value: req.UserAgent()},
+		{name: "duration_ms", value: strconv.FormatInt(time.Since(c.start).Milliseconds(), 10), number: true},
+		{name: "age", value: getHeader(respHeader, HeaderAge), number: true},
+		{name: "env", value: getHeader(respHeader, HeaderEnvironment)},
+		{name: "key", value: masked},
+		{name: "key_len", value: keyLenStr, number: true},
+		{name: "server", value: getHeader(req.Header, HeaderXServer)},
+	}
+}
+
+// writeAccessLogJSON writes the access log fields as one JSON object and a newline.
+func (c *captureWriter) writeAccessLogJSON(builder *strings.Builder, req *http.Request) {
+	builder.WriteByte('{')
+
+	for idx, field := range c.accessLogFields(req) {
+		if idx > 0 {
+			builder.WriteByte(',')
+		}
+
+		builder.WriteByte('"')
+		builder.WriteString(field.name)
+		builder.WriteString("\":")
+
+		switch {
+		case field.number && field.value == "":
+			builder.WriteString("null")
+		case field.number:
+			builder.WriteString(field.value)
+		default:
+			writeQuoted(builder, field.value)
+		}
+	}
+
+	builder.WriteString("}\n")
+}
+
+// writeAccessLogLogfmt writes the access log fields as key=value pairs and a newline.
+// Values with spaces, quotes or = are quoted; empty values are written as key=.
+func (c *captureWriter) writeAccessLogLogfmt(builder *strings.Builder, req *http.Request) {
+	for idx, field := range c.accessLogFields(req) {
+		if idx > 0 {
+			builder.WriteByte(' ')
+		}
+
+		builder.WriteString(field.name)
+		builder.WriteByte('=')
+
+		if needsQuote(field.value) {
+			writeQuoted(builder, field.value)
+		} else {
+			builder.WriteString(field.value)
+		}
+	}
+
+	builder.WriteByte('\n')
+}
+
+// needsQuote returns true if a logfmt value must be quoted.
+func needsQuote(value string) bool {
+	for idx := range len(value) {
+		if b := value[idx]; b <= ' ' || b == '=' || b == '"' || b == '\\' || b == 0x7f {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeQuoted writes value as a JSON string, which logfmt parsers also accept.
+// Invalid UTF-8 is replaced with U+FFFD.
+func writeQuoted(builder *strings.Builder, value string) {
+	const hex = "0123456789abcdef"
+
+	builder.WriteByte('"')
+
+	start := 0
+
+	for idx := 0; idx < len(value); {
+		char := value[idx]
+		if char >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(value[idx:])
+			if r == utf8.RuneError && size == 1 {
+				builder.WriteString(value[start:idx])
+				builder.WriteString(`\ufffd`)
+				start = idx + size
+			}
+
+			idx += size
+
+			continue
+		}
+
+		if char >= ' ' && char != '"' && char != '\\' {
+			idx++
+			continue
+		}
+
+		builder.WriteString(value[start:idx])
+
+		switch char {
+		case '"', '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(char)
+		case '\n':
+			builder.WriteString(`\n`)
+		case '\r':
+			builder.WriteString(`\r`)
+		case '\t':
+			builder.WriteString(`\t`)
+		default:
+			builder.WriteString(`\u00`)
+			builder.WriteByte(hex[char>>4])
+			builder.WriteByte(hex[char&0xf])
+		}
+
+		idx++
+		start = idx
+	}
+
+	builder.WriteString(value[start:])
+	builder.WriteByte('"')
+}
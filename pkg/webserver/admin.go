@@ -0,0 +1,176 @@
+package webserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* This file contains the authentication layer for the admin endpoints (/stats, /reload, /metrics, etc). */
+
+// AdminConfig protects every endpoint except /auth. All fields are optional.
+// When AllowNets is set, requests must come from one of those networks.
+// When Token or Users are set, requests must also provide valid credentials.
+// When nothing is set the admin endpoints are open, and a warning is logged on startup.
+type AdminConfig struct {
+	// Token is a shared secret accepted as "Authorization: Bearer <token>".
+	Token string `json:"-" toml:"token" xml:"token"`
+	// Users is a list of HTTP basic auth users in the format "username:bcrypt-hash".
+	Users []string `json:"-" toml:"users" xml:"user"`
+	// AllowNets is a list of CIDRs or IPs allowed to reach the admin endpoints.
+	// The request's remote address is used; X-Forwarded-For is not trusted.
+	AllowNets []string `json:"allowNets,omitempty" toml:"allow_nets" xml:"allow_net"`
+	// AllowUnmask allows unmask=true on /stats/keys, /stats/servers and /stats/server/{id} to show full API keys.
+	AllowUnmask bool `json:"allowUnmask,omitempty" toml:"allow_unmask" xml:"allow_unmask"`
+}
+
+// adminAuth is the parsed and validated form of AdminConfig.
+type adminAuth struct {
+	token []byte
+	users map[string][]byte // username -> bcrypt hash.
+	nets  []netip.Prefix
+	// unmask allows full API keys in the cache lists and server info.
+	unmask bool
+}
+
+// ErrInvalidAdminUser is returned when an admin user is not in the "username:bcrypt-hash" format.
+var ErrInvalidAdminUser = errors.New("admin user must be in the format username:bcrypt-hash")
+
+// newAdminAuth parses an admin config. A nil config returns an open (no auth) adminAuth.
+func newAdminAuth(config *AdminConfig) (*adminAuth, error) {
+	auth := &adminAuth{users: make(map[string][]byte)}
+	if config == nil {
+		return auth, nil
+	}
+
+	if config.Token != "" {
+		auth.token = []byte(config.Token)
+	}
+
+	auth.unmask = config.AllowUnmask
+
+	for _, user := range config.Users {
+		name, hash, found := strings.Cut(user, ":")
+		if !found || name == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAdminUser, name)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("admin user %s: %w", name, err)
+		}
+
+		auth.users[name] = []byte(hash)
+	}
+
+	for _, cidr := range config.AllowNets {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, err2 := netip.ParseAddr(cidr)
+			if err2 != nil {
+				return nil, fmt.Errorf("admin allow net %q: %w", cidr, err)
+			}
+
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		auth.nets = append(auth.nets, prefix.Masked())
+	}
+
+	return auth, nil
+}
+
+// open returns true if no admin authentication is configured.
+func (a *adminAuth) open() bool {
+	return a == nil || (len(a.token) == 0 && len(a.users) == 0 && len(a.nets) == 0)
+}
+
+// allowedNet returns true if the remote address is in an allowed network, or none are configured.
+func (a *adminAuth) allowedNet(remoteAddr string) bool {
+	if len(a.nets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = strings.Trim(remoteAddr, "[]")
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+
+	for _, prefix := range a.nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validCredentials returns true if the request has a valid bearer token or basic auth user,
+// or if no credentials are configured.
+func (a *adminAuth) validCredentials(req *http.Request) bool {
+	if len(a.token) == 0 && len(a.users) == 0 {
+		return true
+	}
+
+	if token, found := strings.CutPrefix(getHeader(req.Header, "Authorization"), "Bearer "); found {
+		return len(a.token) > 0 && subtle.ConstantTimeCompare([]byte(token), a.token) == 1
+	}
+
+	name, pass, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	hash, ok := a.users[name]
+	if !ok {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(pass)) == nil
+}
+
+// adminWrap protects an admin handler with the configured admin authentication.
+func (s *server) adminWrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch {
+		case s.admin.open():
+			next.ServeHTTP(resp, req)
+		case !s.admin.allowedNet(req.RemoteAddr):
+			s.metrics.CountAdminReject(exp.AdminRejectNetwork)
+			http.Error(resp, "forbidden", http.StatusForbidden)
+		case !s.admin.validCredentials(req):
+			s.metrics.CountAdminReject(exp.AdminRejectCredentials)
+
+			if len(s.admin.users) > 0 {
+				resp.Header().Set("Www-Authenticate", `Basic realm="auth proxy admin"`)
+			}
+
+			http.Error(resp, "invalid request", http.StatusUnauthorized)
+		default:
+			next.ServeHTTP(resp, req)
+		}
+	})
+}
+
+// adminHandleFunc registers an admin handler function with the admin authentication wrapper.
+func (s *server) adminHandleFunc(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.Handle(pattern, s.adminWrap(handler))
+}
+
+// allowUnmask returns true if the cache lists may show full API keys.
+func (a *adminAuth) allowUnmask() bool {
+	return a != nil && a.unmask
+}
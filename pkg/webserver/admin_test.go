@@ -0,0 +1,143 @@
+//nolint:testpackage // Tests unexported admin auth.
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func adminTestHandler(t *testing.T, config *AdminConfig) http.Handler {
+	t.Helper()
+
+	admin, err := newAdminAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{Config: &Config{}, admin: admin}
+
+	return s.adminWrap(http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+	}))
+}
+
+func adminTestRequest(remoteAddr string) *http.Request {
+	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stats/keys", nil)
+	req.RemoteAddr = remoteAddr
+
+	return req
+}
+
+func TestAdminWrap_open(t *testing.T) {
+	t.Parallel()
+
+	rec := httptest.NewRecorder()
+	adminTestHandler(t, nil).ServeHTTP(rec, adminTestRequest("192.0.2.1:1234"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminWrap_token(t *testing.T) {
+	t.Parallel()
+
+	handler := adminTestHandler(t, &AdminConfig{Token: "sekret"})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, adminTestRequest("192.0.2.1:1234"))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: status = %d, want 401", rec.Code)
+	}
+
+	req := adminTestRequest("192.0.2.1:1234")
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("bad token: status = %d, want 401", rec.Code)
+	}
+
+	req = adminTestRequest("192.0.2.1:1234")
+	req.Header.Set("Authorization", "Bearer sekret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("good token: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminWrap_basicUser(t *testing.T) {
+	t.Parallel()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := adminTestHandler(t, &AdminConfig{Users: []string{"admin:" + string(hash)}})
+
+	req := adminTestRequest("192.0.2.1:1234")
+	req.SetBasicAuth("admin", "nope")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("bad password: status = %d, want 401", rec.Code)
+	}
+
+	if rec.Header().Get("Www-Authenticate") == "" {
+		t.Fatal("expected Www-Authenticate header with basic users configured")
+	}
+
+	req = adminTestRequest("192.0.2.1:1234")
+	req.SetBasicAuth("admin", "pass")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("good password: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminWrap_allowNets(t *testing.T) {
+	t.Parallel()
+
+	handler := adminTestHandler(t, &AdminConfig{AllowNets: []string{"10.0.0.0/8", "2001:db8::1"}})
+
+	for addr, want := range map[string]int{
+		"10.1.2.3:5555":        http.StatusOK,
+		"[::ffff:10.1.2.3]:80": http.StatusOK,
+		"[2001:db8::1]:443":    http.StatusOK,
+		"192.0.2.1:1234":       http.StatusForbidden,
+		"garbage":              http.StatusForbidden,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, adminTestRequest(addr))
+
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", addr, rec.Code, want)
+		}
+	}
+}
+
+func TestNewAdminAuth_invalid(t *testing.T) {
+	t.Parallel()
+
+	for name, config := range map[string]*AdminConfig{
+		"user without hash": {Users: []string{"admin"}},
+		"user bad hash":     {Users: []string{"admin:plaintext"}},
+		"bad network":       {AllowNets: []string{"10.0.0.0/33"}},
+	} {
+		if _, err := newAdminAuth(config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -21,10 +21,16 @@ type parsedAPIKeyCtxKey struct{}
 // allocating the split slice). If that segment contains "?", only the part before it is returned.
 // If pathStr has fewer than keyPosition+1 segments, it returns "".
 func GetAPIKeyFromURIPath(pathStr string) string {
+	return uriSegment(pathStr, keyPosition)
+}
+
+// uriSegment returns segment of strings.Split(pathStr, "/"), like GetAPIKeyFromURIPath
+// does for keyPosition. Path key rules use it with their configured segment.
+func uriSegment(pathStr string, segment int) string {
 	segIdx := 0
 
 	for seg := range strings.SplitSeq(pathStr, "/") {
-		if segIdx == keyPosition {
+		if segIdx == segment {
 			before, _, _ := strings.Cut(seg, "?")
 			return before
 		}
@@ -41,19 +47,17 @@ func apiKeyFromRequest(req *http.Request) string {
 	return v
 }
 
-// parseAPIKey attaches the parsed API key to req's context for downstream handlers,
+// parseAPIKey attaches the API key found by the key rules to req's context for downstream handlers,
 // or returns a 401 if no key is found.
 func (s *server) parseAPIKey(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		key := getHeader(req.Header, HeaderXAPIKey)
-		if len(key) != keyLength {
-			key = GetAPIKeyFromURIPath(getHeader(req.Header, HeaderXOriginalURI))
-		}
-
+		key, rule, ok := s.findKey(req.Header, getHeader(req.Header, HeaderXOriginalURI))
 		req = req.WithContext(context.WithValue(req.Context(), parsedAPIKeyCtxKey{}, key))
+		s.metrics.CountKeyRule(rule)
 
-		if len(key) != keyLength {
+		if !ok {
 			s.metrics.HTTPRequests.WithLabelValues(exp.HTTPEventInvalidKey).Inc()
+			s.countNoKey(s.noKeyStatus(getHeader(req.Header, HeaderXOriginalURI)))
 			s.noKeyReply(resp, req) // bad key, bail out.
 		} else {
 			next.ServeHTTP(resp, req)
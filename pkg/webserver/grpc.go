@@ -0,0 +1,187 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+/* This file contains the Envoy external authorization (ext_authz) gRPC server. */
+
+// extAuthz implements Envoy's external authorization Check API on top of the same caches and lookups as /auth.
+type extAuthz struct {
+	authv3.UnimplementedAuthorizationServer
+
+	*server
+}
+
+// startGRPCServer starts the ext_authz gRPC listener when GRPCListenAddr is set.
+// The returned function blocks until the gRPC server stops after ctx is cancelled.
+func (s *server) startGRPCServer(ctx context.Context) (func(), error) {
+	if s.GRPCListenAddr == "" {
+		return func() {}, nil
+	}
+
+	listener, err := (&net.ListenConfig{}).Listen(ctx, "tcp", s.GRPCListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start grpc server: %w", err)
+	}
+
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, &extAuthz{server: s})
+	s.Printf("gRPC ext_authz listening at: %s", listener.Addr())
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if err := grpcServer.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			s.Printf("[ERROR] gRPC server: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+
+		timer := time.AfterFunc(s.shutdownTimeout(), grpcServer.Stop) // abandon checks still running at the deadline.
+		defer timer.Stop()
+
+		grpcServer.GracefulStop()
+	}()
+
+	return func() { <-done }, nil
+}
+
+// Check authorizes one request from Envoy. The api key is found with the same key rules as /auth,
+// using the request path, with its query, as the request uri. An x-original-uri header is
+// ignored: Envoy passes client headers through, so a client could claim a no-auth path with it.
+func (e *extAuthz) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	e.inflight.Add(1)
+	defer e.inflight.Done()
+
+	httpReq := req.GetAttributes().GetRequest().GetHttp()
+	reqHeader := make(http.Header, len(httpReq.GetHeaders()))
+
+	for name, value := range httpReq.GetHeaders() { // envoy sends lowercase header names.
+		reqHeader.Set(name, value)
+	}
+
+	reqHeader.Del(HeaderXOriginalURI)
+	uri := httpReq.GetPath() // envoy includes the query in the path.
+
+	ctx = tracePropagator.Extract(ctx, propagation.HeaderCarrier(reqHeader))
+	ctx, span := e.startSpan(ctx, "check", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	serverID := getHeader(reqHeader, HeaderXServer)
+	key, rule, found := e.findKey(reqHeader, uri)
+	header := http.Header{}
+
+	var status int
+
+	switch {
+	case serverID != "" && getHeader(reqHeader, HeaderXAPIKey) == e.Password:
+		status = e.checkKey(ctx, header, uri, "", keyReq{
+			label: "servers",
+			key:   serverID,
+			store: e.servers,
+			get:   e.ui.GetServer,
+			save:  e.servers.Save,
+		})
+	case !found:
+		e.metrics.CountKeyRule(rule)
+		e.metrics.HTTPRequests.WithLabelValues(exp.HTTPEventInvalidKey).Inc()
+		header.Set(HeaderXAPIKey, key)
+		status = e.noKeyStatus(uri)
+		e.countNoKey(status)
+	default:
+		e.metrics.CountKeyRule(rule)
+		status = e.checkKey(ctx, header, uri, key, keyReq{
+			label: "users",
+			key:   key,
+			store: e.users,
+			get:   e.ui.GetInfo,
+			save:  e.users.Save,
+		})
+	}
+
+	e.metrics.CountCheck(serverID != "", strconv.Itoa(status))
+	endAuthSpan(span, status)
+
+	return checkResponse(status, header), nil
+}
+
+// checkKey authorizes a user or server, and sets the response headers like writeAuthResult.
+// Returns the http status code for the response.
+func (e *extAuthz) checkKey(ctx context.Context, header http.Header, uri, apiKey string, keyReq keyReq) int {
+	res := e.authorize(ctx, keyReq)
+	e.setAuthHeaders(header, res)
+
+	status := http.StatusOK
+
+	if res.denied() {
+		header.Set(HeaderXAPIKey, apiKey)
+		status = e.noKeyStatus(uri)
+	} else if limited := e.checkRateLimit(header, res, uri); limited != 0 {
+		status = limited
+	}
+
+	e.countDecision(res, status)
+
+	return status
+}
+
+// checkResponse converts a status and headers into an ext_authz response.
+// Allowed requests have the headers set on the upstream request, replacing any the client sent.
+// Denied requests get the status and headers sent back to the client.
+func checkResponse(status int, header http.Header) *authv3.CheckResponse {
+	options := make([]*corev3.HeaderValueOption, 0, len(header))
+	var client []*corev3.HeaderValueOption // rate limit headers go to the client, not the upstream.
+
+	for name := range header {
+		option := &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: name, Value: header.Get(name)},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		}
+
+		if status == http.StatusOK && strings.HasPrefix(name, "X-Ratelimit-") {
+			client = append(client, option)
+		} else {
+			options = append(options, option)
+		}
+	}
+
+	if status == http.StatusOK {
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{
+				Headers:              options,
+				ResponseHeadersToAdd: client,
+			}},
+		}
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.Unauthenticated)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode(status)}, //nolint:gosec // http status codes fit.
+			Headers: options,
+		}},
+	}
+}
@@ -0,0 +1,147 @@
+//nolint:testpackage // Tests the unexported ext_authz server with a fake backend.
+package webserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+)
+
+func checkRequest(path string, headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+		Request: &authv3.AttributeContext_Request{
+			Http: &authv3.AttributeContext_HttpRequest{Method: "GET", Path: path, Headers: headers},
+		},
+	}}
+}
+
+// okHeaders returns the headers of an OK response, or fails the test if the request was denied.
+func okHeaders(t *testing.T, resp *authv3.CheckResponse) map[string]string {
+	t.Helper()
+
+	if resp.GetStatus().GetCode() != int32(codes.OK) || resp.GetOkResponse() == nil {
+		t.Fatalf("expected OK response, got %v", resp)
+	}
+
+	headers := map[string]string{}
+	for _, option := range resp.GetOkResponse().GetHeaders() {
+		headers[option.GetHeader().GetKey()] = option.GetHeader().GetValue()
+	}
+
+	return headers
+}
+
+func TestExtAuthzCheck_keyFromPath(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	resp, err := (&extAuthz{server: srv}).Check(context.Background(),
+		checkRequest("/api/v1/route/method/"+TestAccessLogAPIKey+"?x=1", nil))
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	headers := okHeaders(t, resp)
+	if headers[HeaderXUsername] != "alice" || headers[HeaderEnvironment] != "dev" || headers[HeaderXUserid] != "1001" {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+
+	if srv.users.Get(TestAccessLogAPIKey) == nil {
+		t.Fatal("expected the user to be cached")
+	}
+}
+
+func TestExtAuthzCheck_keyFromHeader(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	resp, _ := (&extAuthz{server: srv}).Check(context.Background(),
+		checkRequest("/api/v1/route/method", map[string]string{"x-api-key": TestAccessLogAPIKey}))
+
+	if headers := okHeaders(t, resp); headers[HeaderXUsername] != "alice" {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+}
+
+func TestExtAuthzCheck_rateLimitHeaders(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	srv.limiter, _ = newTestLimiter(t, &RateLimitConfig{Limits: []*RateLimit{{Requests: 5, Per: time.Minute}}})
+
+	resp, err := (&extAuthz{server: srv}).Check(context.Background(),
+		checkRequest("/", map[string]string{"x-api-key": TestAccessLogAPIKey}))
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	if _, ok := okHeaders(t, resp)[HeaderXRateLimitRemaining]; ok {
+		t.Fatal("rate limit headers must not be sent upstream")
+	}
+
+	client := map[string]string{}
+	for _, option := range resp.GetOkResponse().GetResponseHeadersToAdd() {
+		client[option.GetHeader().GetKey()] = option.GetHeader().GetValue()
+	}
+
+	if client[HeaderXRateLimitLimit] != "5" || client[HeaderXRateLimitRemaining] != "4" {
+		t.Fatalf("client headers = %v, want limit 5 and 4 remaining", client)
+	}
+}
+
+func TestExtAuthzCheck_denied(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{NoAuthPaths: []string{"/api/v1/public"}})
+	authz := &extAuthz{server: srv}
+
+	for _, path := range []string{
+		"/api/v1/route/method", // no key.
+		"/api/v1/route/method/ffffffff-bbbb-cccc-dddd-eeeeeeeeeeee", // unknown key.
+	} {
+		resp, _ := authz.Check(context.Background(), checkRequest(path, nil))
+		if resp.GetStatus().GetCode() != int32(codes.Unauthenticated) ||
+			resp.GetDeniedResponse().GetStatus().GetCode() != typev3.StatusCode_Unauthorized {
+			t.Fatalf("%s: expected a 401 denied response, got %v", path, resp)
+		}
+	}
+
+	resp, _ := authz.Check(context.Background(), checkRequest("/api/v1/public/thing", nil))
+	okHeaders(t, resp)
+}
+
+func TestExtAuthzCheck_spoofedOriginalURI(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{NoAuthPaths: []string{"/api/v1/public"}})
+	resp, _ := (&extAuthz{server: srv}).Check(context.Background(),
+		checkRequest("/api/v1/route/method", map[string]string{"x-original-uri": "/api/v1/public/thing"}))
+
+	if resp.GetDeniedResponse().GetStatus().GetCode() != typev3.StatusCode_Unauthorized {
+		t.Fatalf("a client x-original-uri with a public path must not skip the key: %v", resp)
+	}
+
+	// The key is not read from the spoofed uri either.
+	resp, _ = (&extAuthz{server: srv}).Check(context.Background(),
+		checkRequest("/api/v1/route/method", map[string]string{"x-original-uri": "/api/v1/route/method/" + TestAccessLogAPIKey}))
+
+	if resp.GetDeniedResponse().GetStatus().GetCode() != typev3.StatusCode_Unauthorized {
+		t.Fatalf("the key must come from the request path: %v", resp)
+	}
+}
+
+func TestExtAuthzCheck_server(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{Password: "website-secret"})
+	resp, _ := (&extAuthz{server: srv}).Check(context.Background(),
+		checkRequest("/", map[string]string{"x-server": "1234", "x-api-key": "website-secret"}))
+
+	if headers := okHeaders(t, resp); headers[HeaderEnvironment] != "live" {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+}
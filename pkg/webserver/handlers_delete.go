@@ -2,7 +2,9 @@ package webserver
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -39,6 +41,7 @@ func (s *server) handleDelSrv(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	defer s.servers.Delete(serverID)
+	defer s.deleteStale("servers", serverID)
 
 	// These headers are mostly for logs.
 	if user != nil && user.UserID != userinfo.DefaultUserID {
@@ -72,6 +75,7 @@ func (s *server) handleDelKey(resp http.ResponseWriter, req *http.Request) {
 	for idx, key := range keys {
 		infos[idx] = s.users.Get(key)
 		defer s.users.Delete(key)
+		defer s.deleteStale("users", key)
 
 		if infos[idx] != nil && infos[idx].Data != nil {
 			user, _ = infos[idx].Data.(*userinfo.UserInfo)
@@ -94,3 +98,114 @@ func (s *server) handleDelKey(resp http.ResponseWriter, req *http.Request) {
 		s.Printf("[ERROR] writing response: %v", err)
 	}
 }
+
+// ErrNoCacheFilter is returned when a bulk cache delete has no filter, so it cannot empty the caches by accident.
+var ErrNoCacheFilter = errors.New("provide at least one of userId, username, environment or prefix")
+
+// cacheFilter selects cached users and servers to delete. Every filter that is set must match.
+type cacheFilter struct {
+	userID      string
+	username    string
+	environment string
+	prefix      string // API key prefix.
+}
+
+func parseCacheFilter(query url.Values) (*cacheFilter, error) {
+	filter := &cacheFilter{
+		userID:      query.Get("userId"),
+		username:    query.Get("username"),
+		environment: query.Get("environment"),
+		prefix:      query.Get("prefix"),
+	}
+
+	if *filter == (cacheFilter{}) {
+		return nil, ErrNoCacheFilter
+	}
+
+	return filter, nil
+}
+
+// matches returns true if a cached user or server matches the filter. The prefix is matched
+// to the API key: the cache key in the users cache, and the owner's key in the servers cache.
+func (f *cacheFilter) matches(label, key string, user *userinfo.UserInfo) bool {
+	if label == "servers" {
+		key = user.APIKey
+	}
+
+	return (f.userID == "" || f.userID == user.UserID) &&
+		(f.username == "" || strings.EqualFold(f.username, user.Username)) &&
+		(f.environment == "" || f.environment == user.Environment) &&
+		(f.prefix == "" || strings.HasPrefix(key, f.prefix))
+}
+
+// @Description  Delete every cached user and server that matches all of the provided filters, from the users,
+// @Description  servers and stale caches. Use this when a user is banned or rotates their keys.
+// @Summary      Delete Matching Cache Entries
+// @Tags         auth
+// @Produce      json
+// @Param        userId       query  string  false  "Delete the entries for this user ID."
+// @Param        username     query  string  false  "Delete the entries for this username."
+// @Param        environment  query  string  false  "Delete the entries in this environment."
+// @Param        prefix       query  string  false  "Delete the entries with an API key that starts with this prefix."
+// @Success      200  {object} []cache.Item{data=userinfo.UserInfo} "List of cached info for API Keys and servers that were deleted."
+// @Failure      400  {object} string "no filter provided"
+// @Failure      401  {object} string "invalid request"
+// @Router       /cache [delete]
+func (s *server) handleDelMatching(resp http.ResponseWriter, req *http.Request) {
+	filter, err := parseCacheFilter(req.URL.Query())
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	infos := s.deleteMatching(filter)
+	for _, info := range infos {
+		// Something is better than nothing.
+		if user, _ := info.Data.(*userinfo.UserInfo); user != nil && user.UserID != userinfo.DefaultUserID {
+			resp.Header().Set(HeaderXUserid, user.UserID)
+			resp.Header().Set(HeaderXUsername, user.Username)
+		}
+	}
+
+	resp.Header().Set(HeaderEnvironment, "deleted")
+	resp.Header().Set(HeaderContentType, "application/json")
+	resp.Header().Set(HeaderAge, strconv.Itoa(len(infos)))
+	resp.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(resp).Encode(infos)
+	if err != nil {
+		s.Printf("[ERROR] writing response: %v", err)
+	}
+}
+
+// deleteMatching deletes the matching users and servers, and their stale copies. Stale entries
+// that are no longer in the users or servers cache are deleted too, and included in the reply.
+func (s *server) deleteMatching(filter *cacheFilter) []*cache.Item {
+	infos := []*cache.Item{}
+	deleted := map[string]bool{} // stale keys of the deleted items.
+
+	for _, store := range []keyReq{{label: "users", store: s.users}, {label: "servers", store: s.servers}} {
+		for key, item := range store.store.List() {
+			if user, ok := item.Data.(*userinfo.UserInfo); ok && filter.matches(store.label, key, user) {
+				store.store.Delete(key)
+				s.deleteStale(store.label, key)
+				deleted[staleKey(store.label, key)] = true
+				infos = append(infos, item)
+			}
+		}
+	}
+
+	if s.stale == nil {
+		return infos
+	}
+
+	for key, item := range s.stale.List() {
+		label, cacheKey, _ := strings.Cut(key, ":")
+		if user, ok := item.Data.(*userinfo.UserInfo); ok && !deleted[key] && filter.matches(label, cacheKey, user) {
+			s.stale.Delete(key)
+			infos = append(infos, item)
+		}
+	}
+
+	return infos
+}
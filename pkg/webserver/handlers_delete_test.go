@@ -0,0 +1,78 @@
+//nolint:testpackage // Tests the unexported delete handlers.
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"golift.io/cache"
+)
+
+func deleteCacheRequest(query string) *http.Request {
+	return httptest.NewRequestWithContext(context.Background(), http.MethodDelete, "/cache?"+query, nil)
+}
+
+func TestHandleDelMatching(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{Password: "website-secret", StaleMaxAge: time.Hour})
+	srv.stale = cache.New(cache.Config{})
+	t.Cleanup(func() { srv.stale.Stop(false) })
+
+	// User 1001 has a cached key, a cached server, and an old key that is only in the stale store.
+	srv.handleAuth(httptest.NewRecorder(), authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+	srv.handleAuth(httptest.NewRecorder(), authRequest(map[string]string{HeaderXServer: "1234", HeaderXAPIKey: "website-secret"}))
+	srv.saveStale("users", "old-key", &userinfo.UserInfo{APIKey: "old-key", UserID: "1001"}, time.Now())
+
+	other := &userinfo.UserInfo{APIKey: "other-key", Environment: "dev", Username: "bob", UserID: "2002"}
+	srv.users.Save(other.APIKey, other, cache.Options{})
+
+	rec := httptest.NewRecorder()
+	srv.handleDelMatching(rec, deleteCacheRequest(""))
+
+	if rec.Code != http.StatusBadRequest || srv.users.Get(other.APIKey) == nil {
+		t.Fatalf("no filter: status %d, want 400 and nothing deleted", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.handleDelMatching(rec, deleteCacheRequest("userId=1001"))
+
+	var deleted []*cache.Item
+	if err := json.Unmarshal(rec.Body.Bytes(), &deleted); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, decoding %q: %v", rec.Code, rec.Body.String(), err)
+	}
+
+	// The key and the server, with their stale copies, and the stale-only key.
+	if len(deleted) != 3 || rec.Header().Get(HeaderXUserid) != "1001" || rec.Header().Get(HeaderAge) != "3" {
+		t.Fatalf("deleted %d items with headers %v: %s", len(deleted), rec.Header(), rec.Body.String())
+	}
+
+	if srv.users.Get(TestAccessLogAPIKey) != nil || srv.servers.Get("1234") != nil || len(srv.stale.List()) != 0 {
+		t.Fatal("user 1001 is still cached")
+	}
+
+	if srv.users.Get(other.APIKey) == nil {
+		t.Fatal("user 2002 was deleted")
+	}
+}
+
+func TestCacheFilter_prefix(t *testing.T) {
+	t.Parallel()
+
+	filter := &cacheFilter{prefix: "abcd"}
+	user := &userinfo.UserInfo{APIKey: "abcd-1234"}
+
+	if !filter.matches("users", "abcd-1234", user) || filter.matches("users", "ffff-1234", user) {
+		t.Fatal("the prefix must match the users cache key")
+	}
+
+	// Servers are matched by their owner's API key, not the server ID.
+	if !filter.matches("servers", "1234", user) || filter.matches("servers", "abcd", &userinfo.UserInfo{APIKey: "ffff"}) {
+		t.Fatal("the prefix must match the server owner's API key")
+	}
+}
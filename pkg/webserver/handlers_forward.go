@@ -0,0 +1,113 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/* The handlers in this file are used by forward auth proxies: Traefik, Caddy and HAProxy. They only return headers. */
+
+// Proxy modes select which reverse proxy header conventions /auth accepts.
+const (
+	// ProxyModeNginx ignores the X-Forwarded-* headers. Nginx sends X-Original-Uri. This is the default,
+	// because nginx auth_request passes the client's headers through, and a client could otherwise send
+	// its own X-Forwarded-Uri to claim a no-auth path.
+	ProxyModeNginx = "nginx"
+	// ProxyModeTraefik, ProxyModeCaddy and ProxyModeHAProxy treat every /auth request as a forward auth
+	// request, except a DELETE without X-Forwarded-Method, which deletes cache entries.
+	ProxyModeTraefik = "traefik"
+	ProxyModeCaddy   = "caddy"
+	ProxyModeHAProxy = "haproxy"
+)
+
+// HeaderXForwardedMethod is the original request method sent by forward auth proxies.
+const HeaderXForwardedMethod = "X-Forwarded-Method"
+
+// ErrUnknownProxyMode is returned when proxy_mode is not a supported proxy.
+var ErrUnknownProxyMode = errors.New("unknown proxy mode")
+
+// checkProxyMode normalizes and validates the configured proxy mode.
+func (c *Config) checkProxyMode() error {
+	c.ProxyMode = strings.ToLower(c.ProxyMode)
+
+	switch c.ProxyMode {
+	case "":
+		c.ProxyMode = ProxyModeNginx
+	case ProxyModeNginx, ProxyModeTraefik, ProxyModeCaddy, ProxyModeHAProxy:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownProxyMode, c.ProxyMode)
+	}
+
+	return nil
+}
+
+// forwardAuth returns true if an /auth request came from a forward auth proxy.
+// Only the forward auth proxy modes read the X-Forwarded-* headers.
+func (s *server) forwardAuth(req *http.Request) bool {
+	switch s.ProxyMode {
+	case ProxyModeTraefik, ProxyModeCaddy, ProxyModeHAProxy:
+		return req.Method != http.MethodDelete ||
+			getHeader(req.Header, HeaderXForwardedURI) != "" || getHeader(req.Header, HeaderXForwardedMethod) != ""
+	default:
+		return false
+	}
+}
+
+// @Description  Retrieve the environment for an API Key or Server ID. This endpoint is designed for forward auth proxies:
+// @Description Traefik ForwardAuth, Caddy forward_auth and HAProxy. They send the original request in X-Forwarded-Uri,
+// @Description X-Forwarded-Host and X-Forwarded-Method. The API key is parsed from X-Api-Key or X-Forwarded-Uri.
+// @Description /auth accepts the same requests, see proxy_mode. This path treats every request as forward auth.
+// @Summary      Get user or server environment for forward auth proxies
+// @Tags         auth
+// @Param        X-Server        header string false "Discord Server ID to route."
+// @Param        X-Api-Key       header string false "User's API Key to route, or the shared website secret when X-Server is provided."
+// @Param        X-Forwarded-Uri header string false "User's API Key may be provided in this header at URI position 5: /api/v1/route/method/{key}"
+// @Success      200                         "Body is empty on success, check headers."
+// @Header       200 {string} X-Api-Key      "API Key parsed from request."
+// @Header       200 {string} X-Environment  "Environment: live, dev, etc."
+// @Header       200 {string} X-Username     "Username for the user whose API key was provided."
+// @Header       200 {string} X-UserID       "MySQL ID for the user whose API key was provided."
+// @Header       200 {string} Age            "How long this information has been in the cache."
+// @Header       200 {string} X-Auth-Stale   "Set to 1 when the database failed and a stale cached user was served."
+// @Failure      401 {object} string         "invalid request"
+// @Header       401 {string} X-Api-Key      "API Key parsed from request."
+// @Router       /auth/traefik [get]
+func (s *server) handleForwardAuth(resp http.ResponseWriter, req *http.Request) {
+	forwardedHeaders(req)
+
+	if capture, ok := resp.(*captureWriter); ok {
+		capture.logReq = req
+	}
+
+	// Like nginx requests, only GET and HEAD may look up a server. Other methods look up the API key.
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		s.handleLookup(resp, req)
+	default:
+		s.parseAPIKey(http.HandlerFunc(s.handleGetKey)).ServeHTTP(resp, req)
+	}
+}
+
+// forwardedHeaders maps the X-Forwarded-* headers onto the request, so the nginx
+// key parsing and no-auth path checks work unchanged. X-Forwarded-Method replaces the
+// request method, for the access log and the method handling, but a forwarded DELETE
+// is still a lookup, never a delete.
+// Forward auth proxies pass client headers through, so a client's own X-Original-Uri is
+// always replaced or removed; otherwise it could claim a no-auth path for any request.
+func forwardedHeaders(req *http.Request) {
+	if uri := getHeader(req.Header, HeaderXForwardedURI); uri != "" {
+		req.Header.Set(HeaderXOriginalURI, uri)
+	} else {
+		req.Header.Del(HeaderXOriginalURI)
+	}
+
+	if method := getHeader(req.Header, HeaderXForwardedMethod); method != "" {
+		req.Method = strings.ToUpper(method)
+	}
+
+	if host := getHeader(req.Header, HeaderXForwardedHost); host != "" {
+		req.Host = host
+	}
+}
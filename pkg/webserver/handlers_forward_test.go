@@ -0,0 +1,215 @@
+//nolint:testpackage // Tests unexported handlers with a fake backend.
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golift.io/cache"
+)
+
+func TestHandleForwardAuth_keyFromForwardedURI(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	rec := httptest.NewRecorder()
+	req := authRequest(map[string]string{
+		HeaderXForwardedURI:  "/api/v1/route/method/" + TestAccessLogAPIKey + "?x=1",
+		HeaderXForwardedHost: "notifiarr.com",
+		"X-Forwarded-Method": http.MethodDelete,
+	})
+	srv.handleForwardAuth(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	if env, user := rec.Header().Get(HeaderEnvironment), rec.Header().Get(HeaderXUsername); env != "dev" || user != "alice" {
+		t.Fatalf("environment = %q, username = %q, want dev and alice", env, user)
+	}
+
+	if req.Host != "notifiarr.com" {
+		t.Fatalf("host = %q, want the forwarded host", req.Host)
+	}
+
+	if srv.users.Get(TestAccessLogAPIKey) == nil {
+		t.Fatal("a forwarded DELETE must look the key up, not delete it")
+	}
+}
+
+func TestHandleForwardAuth_noAuthPath(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{NoAuthPaths: []string{"/api/v1/public"}})
+
+	for uri, want := range map[string]int{
+		"/api/v1/public/thing": http.StatusOK,
+		"/api/v1/route/method": http.StatusUnauthorized,
+	} {
+		rec := httptest.NewRecorder()
+		srv.handleForwardAuth(rec, authRequest(map[string]string{HeaderXForwardedURI: uri}))
+
+		if rec.Code != want {
+			t.Fatalf("%s: status = %d, want %d", uri, rec.Code, want)
+		}
+	}
+}
+
+func TestHandleForwardAuth_spoofedOriginalURI(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{NoAuthPaths: []string{"/api/v1/public"}})
+
+	for name, headers := range map[string]map[string]string{
+		"forwarded uri":    {HeaderXOriginalURI: "/api/v1/public/thing", HeaderXForwardedURI: "/api/v1/route/method"},
+		"no forwarded uri": {HeaderXOriginalURI: "/api/v1/public/thing", HeaderXForwardedMethod: http.MethodGet},
+	} {
+		rec := httptest.NewRecorder()
+		srv.handleForwardAuth(rec, authRequest(headers))
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: a client X-Original-Uri with a public path got status %d, want 401", name, rec.Code)
+		}
+	}
+}
+
+func TestHandleForwardAuth_forwardedMethod(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{Password: "website-secret", ProxyMode: ProxyModeTraefik})
+	buf := &bytes.Buffer{}
+	handler := srv.accessLogWrap(srv.traceAuth(srv.handleAuth), buf, LogFormatJSON)
+	handler.ServeHTTP(httptest.NewRecorder(), authRequest(map[string]string{
+		HeaderXForwardedURI:    "/api/v1/route/method/" + TestAccessLogAPIKey,
+		HeaderXForwardedHost:   "notifiarr.com",
+		HeaderXForwardedMethod: "post",
+	}))
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("decoding %q: %v", buf.String(), err)
+	}
+
+	if line["method"] != http.MethodPost || line["host"] != "notifiarr.com" || line["username"] != "alice" {
+		t.Fatalf("access log does not show the forwarded request: %s", buf.String())
+	}
+
+	// Only GET and HEAD look up servers.
+	rec := httptest.NewRecorder()
+	srv.handleForwardAuth(rec, authRequest(map[string]string{
+		HeaderXServer: "1234", HeaderXAPIKey: "website-secret", HeaderXForwardedMethod: http.MethodPost,
+	}))
+
+	if rec.Code != http.StatusUnauthorized || srv.servers.Get("1234") != nil {
+		t.Fatalf("forwarded POST with X-Server: status %d, want 401 without a server lookup", rec.Code)
+	}
+}
+
+func TestHandleForwardAuth_server(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{Password: "website-secret"})
+	rec := httptest.NewRecorder()
+	srv.handleForwardAuth(rec, authRequest(map[string]string{HeaderXServer: "1234", HeaderXAPIKey: "website-secret"}))
+
+	if env := rec.Header().Get(HeaderEnvironment); rec.Code != http.StatusOK || env != "live" {
+		t.Fatalf("status = %d, environment = %q, want 200 and live", rec.Code, env)
+	}
+}
+
+func TestHandleAuth_proxyModes(t *testing.T) {
+	t.Parallel()
+
+	forwarded := map[string]string{
+		HeaderXForwardedURI:    "/api/v1/route/method/" + TestAccessLogAPIKey,
+		HeaderXForwardedMethod: http.MethodDelete,
+	}
+
+	for mode, want := range map[string]int{
+		"":               http.StatusUnauthorized, // nginx: X-Forwarded-Uri is ignored, so there is no key.
+		ProxyModeNginx:   http.StatusUnauthorized,
+		ProxyModeTraefik: http.StatusOK,
+		ProxyModeCaddy:   http.StatusOK,
+		ProxyModeHAProxy: http.StatusOK,
+	} {
+		config := &Config{ProxyMode: mode}
+		if err := config.checkProxyMode(); err != nil {
+			t.Fatalf("mode %q: %v", mode, err)
+		}
+
+		srv, _ := newTestServer(t, config)
+		rec := httptest.NewRecorder()
+		srv.handleAuth(rec, authRequest(forwarded))
+
+		if rec.Code != want {
+			t.Fatalf("mode %q: status = %d, want %d", mode, rec.Code, want)
+		}
+	}
+}
+
+func TestHandleAuth_spoofedForwardedURI(t *testing.T) {
+	t.Parallel()
+
+	// nginx passes client headers to /auth, so a client X-Forwarded-Uri must not replace X-Original-Uri.
+	for _, mode := range []string{"", ProxyModeNginx} {
+		config := &Config{ProxyMode: mode, NoAuthPaths: []string{"/api/v1/public"}}
+		if err := config.checkProxyMode(); err != nil {
+			t.Fatalf("mode %q: %v", mode, err)
+		}
+
+		srv, _ := newTestServer(t, config)
+		rec := httptest.NewRecorder()
+		srv.handleAuth(rec, authRequest(map[string]string{
+			HeaderXOriginalURI:     "/api/v1/private/thing",
+			HeaderXForwardedURI:    "/api/v1/public/thing",
+			HeaderXForwardedMethod: http.MethodGet,
+		}))
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("mode %q: a client X-Forwarded-Uri with a public path got status %d, want 401", mode, rec.Code)
+		}
+	}
+}
+
+func TestHandleAuth_proxyModeDelete(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{ProxyMode: ProxyModeCaddy})
+	srv.users.Save(TestAccessLogAPIKey, "cached", cache.Options{})
+
+	req := authRequest(map[string]string{HeaderXAPIKeys: TestAccessLogAPIKey})
+	req.Method = http.MethodDelete
+	srv.handleAuth(httptest.NewRecorder(), req)
+
+	if srv.users.Get(TestAccessLogAPIKey) != nil {
+		t.Fatal("a DELETE without X-Forwarded-Method must still delete cache entries")
+	}
+}
+
+func TestCheckProxyMode(t *testing.T) {
+	t.Parallel()
+
+	config := &Config{ProxyMode: "HAProxy"}
+	if err := config.checkProxyMode(); err != nil || config.ProxyMode != ProxyModeHAProxy {
+		t.Fatalf("mode = %q, err = %v", config.ProxyMode, err)
+	}
+
+	config = &Config{}
+	if err := config.checkProxyMode(); err != nil || config.ProxyMode != ProxyModeNginx {
+		t.Fatalf("default mode = %q, err = %v", config.ProxyMode, err)
+	}
+
+	config = &Config{ProxyMode: "auto"}
+	if err := config.checkProxyMode(); !errors.Is(err, ErrUnknownProxyMode) {
+		t.Fatalf("auto: err = %v, want ErrUnknownProxyMode", err)
+	}
+
+	config = &Config{ProxyMode: "apache"}
+	if err := config.checkProxyMode(); !errors.Is(err, ErrUnknownProxyMode) {
+		t.Fatalf("err = %v, want ErrUnknownProxyMode", err)
+	}
+}
@@ -0,0 +1,146 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* This file contains the liveness and readiness handlers used by orchestrators and upstream checks. */
+
+const (
+	defaultReadyTimeout = 2 * time.Second
+	// readyCacheTime is how long a database ping result is reused, so probes do not flood the database.
+	readyCacheTime = 2 * time.Second
+)
+
+// readyCache holds the last database ping result for /readyz.
+type readyCache struct {
+	mu    sync.Mutex
+	check healthCheck
+	at    time.Time
+	done  chan struct{} // closed when the running ping finishes; nil when no ping is running.
+}
+
+// healthCheck is one readiness check result.
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Elapsed string `json:"elapsed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// healthReply is the body returned by /healthz and /readyz.
+type healthReply struct {
+	Status string                 `json:"status"`
+	Uptime string                 `json:"uptime"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// @Description  Liveness check. Returns 200 while the process is running.
+// @Summary      Liveness check
+// @Tags         health
+// @Produce      json
+// @Success      200  {object} healthReply "Process is alive."
+// @Router       /healthz [get]
+func (s *server) handleHealthz(resp http.ResponseWriter, _ *http.Request) {
+	s.writeHealth(resp, http.StatusOK, &healthReply{Status: "ok", Uptime: s.uptime()})
+}
+
+// @Description  Readiness check. Returns 200 when the database answers a ping within ready_timeout.
+// @Description  Returns 503 otherwise, and once shutdown begins. The ping result is reused for 2 seconds.
+// @Description  The caches are created before the listener starts, so they are not checked.
+// @Summary      Readiness check
+// @Tags         health
+// @Produce      json
+// @Success      200  {object} healthReply "Ready to serve auth requests."
+// @Failure      503  {object} healthReply "Not ready. Check the failed checks."
+// @Router       /readyz [get]
+func (s *server) handleReadyz(resp http.ResponseWriter, _ *http.Request) {
+	reply := &healthReply{Status: "ok", Uptime: s.uptime(), Checks: map[string]healthCheck{
+		"database": s.checkDatabase(),
+		"shutdown": {OK: !s.stopping.Load()},
+	}}
+
+	status := http.StatusOK
+
+	for _, check := range reply.Checks {
+		if !check.OK {
+			reply.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	s.writeHealth(resp, status, reply)
+}
+
+// checkDatabase returns the last database ping result, or pings the database when it is older than readyCacheTime.
+// While a ping runs, other probes get the previous result instead of waiting, unless there is none yet.
+func (s *server) checkDatabase() healthCheck {
+	s.readyz.mu.Lock()
+
+	if time.Since(s.readyz.at) < readyCacheTime || (s.readyz.done != nil && !s.readyz.at.IsZero()) {
+		defer s.readyz.mu.Unlock()
+		return s.readyz.check
+	}
+
+	if done := s.readyz.done; done != nil { // the first ping is still running.
+		s.readyz.mu.Unlock()
+		<-done
+		s.readyz.mu.Lock()
+		defer s.readyz.mu.Unlock()
+
+		return s.readyz.check
+	}
+
+	done := make(chan struct{})
+	s.readyz.done = done
+	s.readyz.mu.Unlock()
+
+	check := s.pingDatabase()
+
+	s.readyz.mu.Lock()
+	s.readyz.check, s.readyz.at, s.readyz.done = check, time.Now(), nil
+	s.readyz.mu.Unlock()
+	close(done)
+
+	return check
+}
+
+// pingDatabase pings the database, giving up after ReadyTimeout. The ping result is shared by every
+// probe, so it does not use a probe's request context: one disconnected probe must not fail the others.
+// The error is logged; the unauthenticated reply only says the database is unreachable.
+func (s *server) pingDatabase() healthCheck {
+	timeout := s.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := s.ui.Ping(ctx)
+	check := healthCheck{OK: err == nil, Elapsed: time.Since(start).Round(time.Microsecond).String()}
+
+	if err != nil {
+		s.Printf("[ERROR] Readiness check: database ping: %v", err)
+		check.Error = "unreachable"
+	}
+
+	return check
+}
+
+func (s *server) uptime() string {
+	return time.Since(s.started).Round(time.Second).String()
+}
+
+func (s *server) writeHealth(resp http.ResponseWriter, status int, reply *healthReply) {
+	resp.Header().Set(HeaderContentType, "application/json")
+	resp.WriteHeader(status)
+
+	if err := json.NewEncoder(resp).Encode(reply); err != nil {
+		s.Printf("[ERROR] writing response: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+//nolint:testpackage // Tests unexported health handlers with a fake backend.
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getReadyz(t *testing.T, srv *server) (int, *healthReply) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	srv.handleReadyz(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/readyz", nil))
+
+	var reply healthReply
+	if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil {
+		t.Fatalf("decoding reply: %v", err)
+	}
+
+	return rec.Code, &reply
+}
+
+func TestHandleHealthz(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, nil)
+	backend.setErr(errFakeDB) // liveness does not check the database.
+
+	rec := httptest.NewRecorder()
+	srv.handleHealthz(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, nil)
+
+	if code, reply := getReadyz(t, srv); code != http.StatusOK || reply.Status != "ok" {
+		t.Fatalf("ready: status %d, reply %+v", code, reply)
+	}
+
+	// The ping result is reused, so the database going down is not seen until it expires.
+	backend.setErr(errFakeDB)
+
+	if code, _ := getReadyz(t, srv); code != http.StatusOK {
+		t.Fatalf("cached ping: status %d, want 200", code)
+	}
+
+	srv.readyz.at = time.Time{}
+
+	code, reply := getReadyz(t, srv)
+	if code != http.StatusServiceUnavailable || reply.Checks["database"].Error != "unreachable" {
+		t.Fatalf("database down: status %d, reply %+v", code, reply)
+	}
+}
+
+func TestHandleReadyz_cancelledProbe(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // a probe that disconnected must not fail the shared ping.
+
+	srv.handleReadyz(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, http.MethodGet, "/readyz", nil))
+
+	if code, reply := getReadyz(t, srv); code != http.StatusOK || !reply.Checks["database"].OK {
+		t.Fatalf("after a cancelled probe: status %d, reply %+v", code, reply)
+	}
+}
+
+func TestHandleReadyz_stopping(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	srv.stopping.Store(true)
+
+	if code, reply := getReadyz(t, srv); code != http.StatusServiceUnavailable || reply.Checks["shutdown"].OK {
+		t.Fatalf("shutting down: status %d, reply %+v", code, reply)
+	}
+}
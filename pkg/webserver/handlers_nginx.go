@@ -7,7 +7,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
 	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"go.opentelemetry.io/otel/trace"
 	"golift.io/cache"
 )
 
@@ -33,7 +35,17 @@ func cacheUserFromGetInto(store *cache.Cache, key string) (*userinfo.UserInfo, t
 		return nil, time.Time{}, false
 	}
 
-	return user, snap.Time, true
+	return user, cachedAt(user, snap.Time), true
+}
+
+// cachedAt returns when a user was cached: the cache's save time, or the original
+// save time of a user restored from the cache snapshot.
+func cachedAt(user *userinfo.UserInfo, saved time.Time) time.Time {
+	if user.Cached.IsZero() {
+		return saved
+	}
+
+	return user.Cached
 }
 
 func (s *server) handleServer(resp http.ResponseWriter, req *http.Request) {
@@ -72,76 +84,167 @@ func (s *server) handleGetKey(resp http.ResponseWriter, req *http.Request) {
 // @Header       200 {string} X-Username     "Username for the user whose API key was provided."
 // @Header       200 {string} X-UserID       "MySQL ID for the user whose API key was provided."
 // @Header       200 {string} Age            "How long this information has been in the cache."
+// @Header       200 {string} X-Auth-Stale   "Set to 1 when the database failed and a stale cached user was served."
 // @Failure      401 {object} string         "invalid request"
 // @Header       401 {string} X-Api-Key      "API Key parsed from request."
 // @Router       /auth [get]
 func (s *server) handleGetAny(resp http.ResponseWriter, req *http.Request, keyReq keyReq) {
-	var (
-		start           = time.Now()
-		err             error
-		user, when, hit = cacheUserFromGetInto(keyReq.store, keyReq.key)
-	)
-
-	if !hit {
-		when = start
-
-		switch user, err = keyReq.get(req.Context(), keyReq.key); {
-		case errors.Is(err, userinfo.ErrNoUser):
-			keyReq.save(keyReq.key, user, cache.Options{Prune: true}) // save the "default user" to the cache.
-		case err != nil:
-			s.Printf("[ERROR] %v", err) // database error.
-		default:
-			keyReq.save(keyReq.key, user, cache.Options{Prune: false}) // save the valid user to the cache.
-		}
+	s.writeAuthResult(resp, req, s.authorize(req.Context(), keyReq))
+}
 
-		if user == nil { // this only happens on error above.
-			user = userinfo.DefaultUser()
-			key, length := maskAPIKey(keyReq.key)
-			s.Println("[ERROR] user missing from cache or lookup", key, length)
-		}
+// authResult is the outcome of an auth lookup for a user or server.
+type authResult struct {
+	label  string
+	key    string // api key or server id from the request.
+	user   *userinfo.UserInfo
+	err    error         // backend error, if any.
+	when   time.Time     // when the user was saved to the cache.
+	start  time.Time     // when the request started.
+	age    time.Duration // age of the user when it was served, set by setAuthHeaders.
+	stale  bool          // user came from the stale store because the backend failed.
+	source string        // cache, db or stale.
+}
+
+// authorize finds a user or server in the cache, or looks it up in the backend.
+// When the backend fails, a recently cached user is served from the stale store.
+func (s *server) authorize(ctx context.Context, keyReq keyReq) *authResult {
+	res := &authResult{label: keyReq.label, key: keyReq.key, start: time.Now()}
+	_, span := s.startSpan(ctx, "cache")
+	user, when, hit := cacheUserFromGetInto(keyReq.store, keyReq.key)
+	res.user, res.when = user, when
+
+	if hit && s.cacheExpired(user, when, res.start) {
+		hit = false
+	}
+
+	if span.IsRecording() {
+		masked, _ := maskAPIKey(keyReq.key)
+		span.SetAttributes(attrLabel.String(keyReq.label), attrCacheHit.Bool(hit), attrKey.String(masked))
+	}
+
+	span.End()
+
+	if hit {
+		res.source = exp.SourceCache
+		s.refreshIfStale(keyReq, user, when, res.start)
+
+		return res
+	}
+
+	res.when = res.start
+	res.source = exp.SourceDB
+
+	if res.user, res.err = s.fetch(ctx, keyReq); res.user != nil {
+		return res
+	}
+
+	// this only happens on error.
+	if user, when, ok := s.staleUser(keyReq); ok {
+		s.metrics.StaleServes.WithLabelValues(keyReq.label).Inc()
+		trace.SpanFromContext(ctx).SetAttributes(attrStale.Bool(true))
+		res.user, res.when, res.stale, res.source = user, when, true, exp.SourceStale
+
+		return res
+	}
+
+	res.user = userinfo.DefaultUser()
+	key, length := maskAPIKey(keyReq.key)
+	s.Println("[ERROR] user missing from cache or lookup", key, length)
+
+	return res
+}
+
+func (s *server) writeAuthResult(resp http.ResponseWriter, req *http.Request, res *authResult) {
+	s.setAuthHeaders(resp.Header(), res)
+
+	uri := getHeader(req.Header, HeaderXOriginalURI)
+	// This may not be right: Server misses may return 200, confirm?
+	status := http.StatusOK
+
+	if res.denied() {
+		resp.Header().Set(HeaderXAPIKey, apiKeyFromRequest(req))
+		status = s.noKeyStatus(uri)
+	} else if limited := s.checkRateLimit(resp.Header(), res, uri); limited != 0 {
+		status = limited
 	}
 
-	s.writeAuthResult(resp, req, keyReq.label, user, err, when, start)
+	s.countDecision(res, status)
+	resp.WriteHeader(status)
 }
 
-func (s *server) writeAuthResult(
-	resp http.ResponseWriter,
-	req *http.Request,
-	label string,
-	user *userinfo.UserInfo,
-	err error,
-	when time.Time,
-	start time.Time,
-) {
+// countDecision records the outcome of an auth request, and the age of the data it was given.
+// User requests are also counted for the most active users and keys.
+func (s *server) countDecision(res *authResult, status int) {
+	result := exp.DecisionAllowed
+
+	switch {
+	case res.err != nil && !errors.Is(res.err, userinfo.ErrNoUser) && !res.stale:
+		result = exp.DecisionDBError
+	case res.denied() && status == http.StatusOK:
+		result = exp.DecisionNoAuthPath
+	case res.denied() || status != http.StatusOK:
+		result = exp.DecisionDenied
+	}
+
+	s.metrics.CountDecision(res.label, result, res.user.Environment, res.source, res.age)
+	s.recordTop(res)
+}
+
+// setAuthHeaders records the request time and sets the user headers for an auth result.
+func (s *server) setAuthHeaders(header http.Header, res *authResult) {
 	finished := time.Now()
-	s.metrics.ReqTime.WithLabelValues(label).Observe(finished.Sub(start).Seconds())
-	resp.Header().Set(HeaderXAPIKey, user.APIKey)
-	resp.Header().Set(HeaderEnvironment, user.Environment)
-	resp.Header().Set(HeaderXUsername, user.Username)
-	resp.Header().Set(HeaderXUserid, user.UserID)
-	resp.Header().Set(HeaderAge, strconv.Itoa(int(finished.Sub(when).Seconds())))
-	// If the user is the default user, and there was no error, then return a 401.
-	if user.UserID == userinfo.DefaultUserID && (err == nil || errors.Is(err, userinfo.ErrNoUser)) {
-		s.noKeyReply(resp, req)
-	} else {
-		// This may not be right: Server misses may return 200, confirm?
-		resp.WriteHeader(http.StatusOK)
-	}
-}
-
-// noKeyReply returns a 401.
+	s.metrics.ReqTime.WithLabelValues(res.label).Observe(finished.Sub(res.start).Seconds())
+	header.Set(HeaderXAPIKey, res.user.APIKey)
+	header.Set(HeaderEnvironment, res.user.Environment)
+	header.Set(HeaderXUsername, res.user.Username)
+	header.Set(HeaderXUserid, res.user.UserID)
+	res.age = finished.Sub(res.when)
+	header.Set(HeaderAge, strconv.Itoa(int(res.age.Seconds())))
+
+	if res.stale {
+		header.Set(HeaderXAuthStale, "1")
+	}
+}
+
+// denied returns true if the user is the default user, and there was no error.
+// Denied requests get a 401 when the path requires an api key.
+func (r *authResult) denied() bool {
+	return r.user.UserID == userinfo.DefaultUserID && (r.err == nil || errors.Is(r.err, userinfo.ErrNoUser))
+}
+
+// noKeyReply returns a 401, or a 200 when the uri does not require an api key.
 func (s *server) noKeyReply(resp http.ResponseWriter, req *http.Request) {
 	resp.Header().Set(HeaderXAPIKey, apiKeyFromRequest(req))
+	resp.WriteHeader(s.noKeyStatus(getHeader(req.Header, HeaderXOriginalURI)))
+}
+
+// countNoKey records the auth decision for an auth request without a valid api key.
+// Requests to / are not auth requests, so noKeyReply does not count them.
+func (s *server) countNoKey(status int) {
+	result := exp.DecisionDenied
+	if status == http.StatusOK {
+		result = exp.DecisionNoAuthPath
+	}
+
+	s.metrics.CountDecision("users", result, userinfo.DefaultEnvironment, exp.SourceNone, 0)
+}
 
-	if s.RequiresAPIKey(getHeader(req.Header, HeaderXOriginalURI)) {
-		resp.WriteHeader(http.StatusUnauthorized)
-	} else {
-		resp.WriteHeader(http.StatusOK)
+// noKeyStatus returns 401 if the uri requires an api key, or 200 if it does not.
+func (s *server) noKeyStatus(uri string) int {
+	if s.RequiresAPIKey(uri) {
+		return http.StatusUnauthorized
 	}
+
+	return http.StatusOK
 }
 
 // handleAuth dispatches /auth by method and headers. This is our primary entry point.
 func (s *server) handleAuth(resp http.ResponseWriter, req *http.Request) {
+	if s.forwardAuth(req) {
+		s.handleForwardAuth(resp, req)
+		return
+	}
+
 	switch req.Method {
 	case http.MethodDelete:
 		if getHeader(req.Header, HeaderXAPIKeys) != "" {
@@ -156,15 +259,20 @@ func (s *server) handleAuth(resp http.ResponseWriter, req *http.Request) {
 
 		http.NotFound(resp, req)
 	case http.MethodGet, http.MethodHead:
-		if getHeader(req.Header, HeaderXServer) != "" && getHeader(req.Header, HeaderXAPIKey) == s.Password {
-			s.handleServer(resp, req)
-			return
-		}
-
-		s.parseAPIKey(http.HandlerFunc(s.handleGetKey)).ServeHTTP(resp, req)
+		s.handleLookup(resp, req)
 	case http.MethodPost, http.MethodPut:
 		s.parseAPIKey(http.HandlerFunc(s.handleGetKey)).ServeHTTP(resp, req)
 	default:
 		http.NotFound(resp, req)
 	}
 }
+
+// handleLookup looks up the server in X-Server when the shared secret is provided, otherwise the user's API key.
+func (s *server) handleLookup(resp http.ResponseWriter, req *http.Request) {
+	if getHeader(req.Header, HeaderXServer) != "" && getHeader(req.Header, HeaderXAPIKey) == s.Password {
+		s.handleServer(resp, req)
+		return
+	}
+
+	s.parseAPIKey(http.HandlerFunc(s.handleGetKey)).ServeHTTP(resp, req)
+}
@@ -0,0 +1,381 @@
+//nolint:testpackage // Tests unexported handlers with a fake backend.
+package webserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golift.io/cache"
+)
+
+var errFakeDB = errors.New("fake database error")
+
+// fakeBackend is an in-memory userinfo.Backend for handler tests.
+type fakeBackend struct {
+	mu      sync.Mutex
+	users   map[string]*userinfo.UserInfo // api key -> user.
+	servers map[string]*userinfo.UserInfo // server id -> user.
+	err     error                         // returned from every lookup when set.
+	delay   time.Duration                 // slows down every lookup when set.
+	calls   atomic.Int64
+}
+
+func (f *fakeBackend) GetInfo(_ context.Context, requestKey string) (*userinfo.UserInfo, error) {
+	f.calls.Add(1)
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	if user, ok := f.users[requestKey]; ok {
+		copied := *user
+		return &copied, nil
+	}
+
+	user := userinfo.DefaultUser()
+	user.APIKey = requestKey
+
+	return user, userinfo.ErrNoUser
+}
+
+func (f *fakeBackend) GetServer(_ context.Context, serverID string) (*userinfo.UserInfo, error) {
+	f.calls.Add(1)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	if user, ok := f.servers[serverID]; ok {
+		copied := *user
+		return &copied, nil
+	}
+
+	return userinfo.DefaultUser(), nil
+}
+
+func (f *fakeBackend) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err //nolint:wrapcheck // like a real ping.
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+func (f *fakeBackend) Close() error { return nil }
+
+func (f *fakeBackend) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+//nolint:gochecknoglobals // prometheus metrics may only be registered once per process.
+var (
+	testMetricsOnce sync.Once
+	testMetricsVal  *exp.Metrics
+)
+
+// testMetrics returns process-wide metrics for tests.
+func testMetrics() *exp.Metrics {
+	testMetricsOnce.Do(func() {
+		testMetricsVal = exp.GetMetrics(&exp.CacheCollector{Stats: exp.CacheList{}})
+	})
+
+	return testMetricsVal
+}
+
+// newTestServer returns a server backed by an in-memory fake with one valid user and server.
+func newTestServer(t *testing.T, config *Config) (*server, *fakeBackend) {
+	t.Helper()
+
+	if config == nil {
+		config = &Config{}
+	}
+
+	if config.Config == nil {
+		config.Config = &userinfo.Config{}
+	}
+
+	if config.Logger == nil {
+		config.Logger = log.New(io.Discard, "", 0)
+	}
+
+	backend := &fakeBackend{
+		users: map[string]*userinfo.UserInfo{
+			TestAccessLogAPIKey: {APIKey: TestAccessLogAPIKey, Environment: "dev", Username: "alice", UserID: "1001"},
+		},
+		servers: map[string]*userinfo.UserInfo{
+			"1234": {APIKey: TestAccessLogAPIKey, Environment: "live", Username: "alice", UserID: "1001"},
+		},
+	}
+
+	srv := &server{
+		Config:  config,
+		users:   cache.New(cache.Config{}),
+		servers: cache.New(cache.Config{}),
+		ui:      backend,
+		metrics: testMetrics(),
+	}
+
+	t.Cleanup(func() {
+		srv.users.Stop(false)
+		srv.servers.Stop(false)
+	})
+
+	return srv, backend
+}
+
+func authRequest(headers map[string]string) *http.Request {
+	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/auth", nil)
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+
+	return req
+}
+
+func TestHandleAuth_validKeyIsCached(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, nil)
+
+	for range 3 {
+		rec := httptest.NewRecorder()
+		srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+
+		if env := rec.Header().Get(HeaderEnvironment); env != "dev" {
+			t.Fatalf("environment = %q, want dev", env)
+		}
+
+		if user := rec.Header().Get(HeaderXUsername); user != "alice" {
+			t.Fatalf("username = %q, want alice", user)
+		}
+	}
+
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Fatalf("backend calls = %d, want 1", calls)
+	}
+}
+
+func TestHandleAuth_keyFromOriginalURI(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{
+		HeaderXOriginalURI: "/api/v1/route/method/" + TestAccessLogAPIKey + "?x=1",
+	}))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	if id := rec.Header().Get(HeaderXUserid); id != "1001" {
+		t.Fatalf("user id = %q, want 1001", id)
+	}
+}
+
+func TestHandleAuth_unknownKey(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: "ffffffff-bbbb-cccc-dddd-eeeeeeeeeeee"}))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rec.Code)
+	}
+
+	if id := rec.Header().Get(HeaderXUserid); id != userinfo.DefaultUserID {
+		t.Fatalf("user id = %q, want %s", id, userinfo.DefaultUserID)
+	}
+}
+
+func TestHandleAuth_invalidKeyLength(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, &Config{NoAuthPaths: []string{"/api/v1/public"}})
+
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: "short"}))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{HeaderXOriginalURI: "/api/v1/public/thing"}))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("no-auth path status = %d, want 200", rec.Code)
+	}
+
+	if calls := backend.calls.Load(); calls != 0 {
+		t.Fatalf("backend calls = %d, want 0", calls)
+	}
+}
+
+func TestHandleAuth_databaseError(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, nil)
+	backend.setErr(errFakeDB)
+
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+	// A database error returns the default user with a 200, so nginx does not lock users out.
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	if env := rec.Header().Get(HeaderEnvironment); env != userinfo.DefaultEnvironment {
+		t.Fatalf("environment = %q, want %s", env, userinfo.DefaultEnvironment)
+	}
+
+	if srv.users.Get(TestAccessLogAPIKey) != nil {
+		t.Fatal("database errors must not be cached")
+	}
+}
+
+func TestHandleAuth_server(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{Password: "website-secret"})
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{HeaderXServer: "1234", HeaderXAPIKey: "website-secret"}))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	if env := rec.Header().Get(HeaderEnvironment); env != "live" {
+		t.Fatalf("environment = %q, want live", env)
+	}
+
+	if srv.servers.Get("1234") == nil {
+		t.Fatal("expected server to be cached")
+	}
+}
+
+//nolint:paralleltest // reads process-wide counters, so no other test may run at the same time.
+func TestHandleAuth_decisionMetrics(t *testing.T) {
+	srv, backend := newTestServer(t, &Config{NoAuthPaths: []string{"/public"}, StaleMaxAge: time.Hour})
+	srv.stale = cache.New(cache.Config{})
+	t.Cleanup(func() { srv.stale.Stop(false) })
+
+	decisions := func(result, env, source string) float64 {
+		return testutil.ToFloat64(srv.metrics.AuthDecisions.WithLabelValues("users", result, env, source))
+	}
+
+	type decision struct{ result, env, source string }
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		dbErr   error
+		want    decision
+	}{
+		{
+			name:    "lookup",
+			headers: map[string]string{HeaderXAPIKey: TestAccessLogAPIKey},
+			want:    decision{exp.DecisionAllowed, "dev", exp.SourceDB},
+		},
+		{
+			name:    "cached",
+			headers: map[string]string{HeaderXAPIKey: TestAccessLogAPIKey},
+			want:    decision{exp.DecisionAllowed, "dev", exp.SourceCache},
+		},
+		{
+			name:    "unknown key",
+			headers: map[string]string{HeaderXAPIKey: "bbbbbbbb-bbbb-cccc-dddd-eeeeeeeeeeee"},
+			want:    decision{exp.DecisionDenied, userinfo.DefaultEnvironment, exp.SourceDB},
+		},
+		{
+			name:    "unknown key, public path",
+			headers: map[string]string{HeaderXAPIKey: "cccccccc-bbbb-cccc-dddd-eeeeeeeeeeee", HeaderXOriginalURI: "/public/page"},
+			want:    decision{exp.DecisionNoAuthPath, userinfo.DefaultEnvironment, exp.SourceDB},
+		},
+		{
+			name:    "database down",
+			headers: map[string]string{HeaderXAPIKey: "dddddddd-bbbb-cccc-dddd-eeeeeeeeeeee"},
+			dbErr:   errFakeDB,
+			want:    decision{exp.DecisionDBError, userinfo.DefaultEnvironment, exp.SourceDB},
+		},
+		{
+			name:    "no key",
+			headers: map[string]string{HeaderXOriginalURI: "/api/v1/route"},
+			want:    decision{exp.DecisionDenied, userinfo.DefaultEnvironment, exp.SourceNone},
+		},
+		{
+			name:    "malformed key",
+			headers: map[string]string{HeaderXAPIKey: "short"},
+			want:    decision{exp.DecisionDenied, userinfo.DefaultEnvironment, exp.SourceNone},
+		},
+		{
+			name:    "no key, public path",
+			headers: map[string]string{HeaderXOriginalURI: "/public/page"},
+			want:    decision{exp.DecisionNoAuthPath, userinfo.DefaultEnvironment, exp.SourceNone},
+		},
+	}
+
+	for _, test := range tests {
+		backend.setErr(test.dbErr)
+		before := decisions(test.want.result, test.want.env, test.want.source)
+
+		srv.handleAuth(httptest.NewRecorder(), authRequest(test.headers))
+
+		if got := decisions(test.want.result, test.want.env, test.want.source) - before; got != 1 {
+			t.Errorf("%s: %+v counted %v times, want 1", test.name, test.want, got)
+		}
+	}
+
+	// Probes to / are not auth decisions.
+	before := decisions(exp.DecisionDenied, userinfo.DefaultEnvironment, exp.SourceNone)
+	srv.noKeyReply(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := decisions(exp.DecisionDenied, userinfo.DefaultEnvironment, exp.SourceNone) - before; got != 0 {
+		t.Errorf("a request to / counted %v decisions, want 0", got)
+	}
+
+	// A stale serve is allowed, and its age is observed.
+	backend.setErr(errFakeDB)
+	srv.users.Delete(TestAccessLogAPIKey)
+
+	before = decisions(exp.DecisionAllowed, "dev", exp.SourceStale)
+	ages := testutil.CollectAndCount(srv.metrics.CacheAge)
+
+	srv.handleAuth(httptest.NewRecorder(), authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+	if got := decisions(exp.DecisionAllowed, "dev", exp.SourceStale) - before; got != 1 {
+		t.Errorf("stale serve counted %v times, want 1", got)
+	}
+
+	if testutil.CollectAndCount(srv.metrics.CacheAge) != ages {
+		t.Error("cache age histograms must be warmed for every cache and source")
+	}
+}
@@ -4,25 +4,37 @@ import (
 	"encoding/json"
 	"net/http"
 	"slices"
+	"time"
 
 	"github.com/Notifiarr/mysql-auth-proxy/docs"
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
 	"github.com/swaggo/swag"
+	"golift.io/cache"
 )
 
 /* This file contains the stats and other handlers. */
 
-// @Description  Retrieve full cached user list.
-// @Summary      Return all cached users
+// @Description  Retrieve a page of the cached user list. API keys are masked unless unmask=true
+// @Description  and the admin allow_unmask setting is enabled.
+// @Summary      Return cached users
 // @Tags         stats
 // @Produce      json
-// @Success      200  {object} map[string]cache.Item{data=userinfo.UserInfo} "List of cached API keys. The map key is the API key."
+// @Param        limit        query  int     false  "Users per page, 1 to 1000. Default: 100."
+// @Param        offset       query  int     false  "Users to skip."
+// @Param        sort         query  string  false  "key (default), access or created. Access and created are newest first."
+// @Param        environment  query  string  false  "Only users in this environment."
+// @Param        username     query  string  false  "Only users with this username."
+// @Param        userId       query  string  false  "Only users with this user ID."
+// @Param        minAge       query  string  false  "Only users cached at least this long ago, e.g. 10m."
+// @Param        maxAge       query  string  false  "Only users cached at most this long ago, e.g. 1h."
+// @Param        unmask       query  bool    false  "Show full API keys. Requires allow_unmask."
+// @Success      200  {object} CachePage "Page of cached users. The key is the API key."
+// @Failure      400  {object} string "invalid query"
 // @Failure      401  {object} string "invalid request"
+// @Failure      403  {object} string "unmask is not allowed"
 // @Router       /stats/keys [get]
-func (s *server) handeUserList(resp http.ResponseWriter, _ *http.Request) {
-	err := json.NewEncoder(resp).Encode(s.users.List())
-	if err != nil {
-		s.Printf("[ERROR] writing response: %v", err)
-	}
+func (s *server) handeUserList(resp http.ResponseWriter, req *http.Request) {
+	s.writeCachePage(resp, req, s.users, true)
 }
 
 // @Description  Retrieve a user's cached info.
@@ -40,31 +52,77 @@ func (s *server) handleUserInfo(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// @Description  Retrieve full cached server list.
-// @Summary      Return all cached servers
+// @Description  Retrieve a page of the cached server list. API keys are masked unless unmask=true
+// @Description  and the admin allow_unmask setting is enabled.
+// @Description  Takes the same paging, sort and filter parameters as /stats/keys.
+// @Summary      Return cached servers
 // @Tags         stats
 // @Produce      json
-// @Success      200  {object} map[string]cache.Item{data=userinfo.UserInfo} "Cached servers. Mp key is server ID."
+// @Param        limit   query  int     false  "Servers per page, 1 to 1000. Default: 100."
+// @Param        offset  query  int     false  "Servers to skip."
+// @Param        unmask  query  bool    false  "Show full API keys. Requires allow_unmask."
+// @Success      200  {object} CachePage "Page of cached servers. The key is the server ID."
+// @Failure      400  {object} string "invalid query"
 // @Failure      401  {object} string "invalid request"
+// @Failure      403  {object} string "unmask is not allowed"
 // @Router       /stats/servers [get]
-func (s *server) handeSrvList(resp http.ResponseWriter, _ *http.Request) {
-	err := json.NewEncoder(resp).Encode(s.servers.List())
+func (s *server) handeSrvList(resp http.ResponseWriter, req *http.Request) {
+	s.writeCachePage(resp, req, s.servers, false)
+}
+
+// writeCachePage writes one page of a cache list. maskKeys is true when the cache keys are API keys.
+func (s *server) writeCachePage(resp http.ResponseWriter, req *http.Request, store *cache.Cache, maskKeys bool) {
+	query, err := parseListQuery(req.URL.Query())
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if query.unmask && !s.admin.allowUnmask() {
+		http.Error(resp, "unmask is not allowed, enable allow_unmask in the admin config", http.StatusForbidden)
+		return
+	}
+
+	err = json.NewEncoder(resp).Encode(query.page(store.List(), maskKeys, time.Now()))
 	if err != nil {
 		s.Printf("[ERROR] writing response: %v", err)
 	}
 }
 
-// @Description  Retrieve a cached server's info.
+// @Description  Retrieve a cached server's info. The owner's API key is masked unless unmask=true
+// @Description  and the admin allow_unmask setting is enabled.
 // @Summary      Return cached server
 // @Tags         stats
 // @Produce      json
-// @Param        key  path   string  true  "Discord Server ID"
+// @Param        key     path   string  true   "Discord Server ID"
+// @Param        unmask  query  bool    false  "Show the full API key. Requires allow_unmask."
 // @Success      200  {object} cache.Item{data=userinfo.UserInfo} "Server's cached info."
+// @Failure      400  {object} string "invalid query"
 // @Failure      401  {object} string "invalid request"
+// @Failure      403  {object} string "unmask is not allowed"
 // @Router       /stats/server/{key} [get]
 func (s *server) handleSrvInfo(resp http.ResponseWriter, req *http.Request) {
-	err := json.NewEncoder(resp).Encode(s.servers.Get(req.PathValue("key")))
+	unmask, err := unmaskParam(req.URL.Query())
 	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if unmask && !s.admin.allowUnmask() {
+		http.Error(resp, "unmask is not allowed, enable allow_unmask in the admin config", http.StatusForbidden)
+		return
+	}
+
+	item := s.servers.Get(req.PathValue("key")) // a copy, but Data is the cached server.
+	if item != nil && !unmask {
+		if user, ok := item.Data.(*userinfo.UserInfo); ok {
+			masked := *user // do not change the cached server.
+			masked.APIKey, _ = maskAPIKey(masked.APIKey)
+			item.Data = &masked
+		}
+	}
+
+	if err = json.NewEncoder(resp).Encode(item); err != nil {
 		s.Printf("[ERROR] writing response: %v", err)
 	}
 }
@@ -74,6 +132,7 @@ func (s *server) handleSrvInfo(resp http.ResponseWriter, req *http.Request) {
 // @Tags         config
 // @Produce      json
 // @Success      200  {object} string "config reloaded: true"
+// @Failure      401  {object} string "invalid request"
 // @Failure      500  {object} string "error reading config"
 // @Router       /reload [get]
 func (s *server) reloadConfig(resp http.ResponseWriter, _ *http.Request) {
@@ -0,0 +1,271 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/* This file contains the configurable API key extraction rules. */
+
+// Key rule types.
+const (
+	KeyRuleHeader        = "header"         // the value of Header.
+	KeyRuleBearer        = "bearer"         // the token in an Authorization: Bearer header.
+	KeyRuleBasicUser     = "basic_user"     // the username in an Authorization: Basic header.
+	KeyRuleBasicPassword = "basic_password" // the password in an Authorization: Basic header.
+	KeyRuleQuery         = "query"          // the Param query parameter in the request uri.
+	KeyRulePath          = "path"           // segment Segment of the request uri path.
+	KeyRuleRegex         = "regex"          // the first capture group of Regex matched against the request uri.
+)
+
+// keyRuleNone is the metric label used when no rule found a valid key.
+const keyRuleNone = "none"
+
+// KeyRule is one place to find an API key in a request. Rules are tried in order, and the first
+// key that passes the rule's validation is used. The request uri is X-Original-Uri (or X-Forwarded-Uri).
+type KeyRule struct {
+	// Name is the metric label for this rule. Default: the type and its parameter, e.g. query:apikey.
+	Name string `json:"name,omitempty" toml:"name" xml:"name"`
+	// Type is one of header, bearer, basic_user, basic_password, query, path or regex.
+	Type string `json:"type" toml:"type" xml:"type"`
+	// Header is the header name for the header type.
+	Header string `json:"header,omitempty" toml:"header" xml:"header"`
+	// Param is the query parameter name for the query type.
+	Param string `json:"param,omitempty" toml:"param" xml:"param"`
+	// Segment is the path segment index for the path type. /api/v1/route/method/{key} is 5.
+	Segment int `json:"segment,omitempty" toml:"segment" xml:"segment"`
+	// Regex is matched against the request uri for the regex type. The first capture group is the key.
+	Regex string `json:"regex,omitempty" toml:"regex" xml:"regex"`
+	// Length is the exact length of a valid key. Default: 36. -1 allows any length.
+	Length int `json:"length,omitempty" toml:"length" xml:"length"`
+	// Format is an optional regular expression a valid key must match in full.
+	Format string `json:"format,omitempty" toml:"format" xml:"format"`
+}
+
+// keyRule is a validated KeyRule with its regular expressions compiled.
+type keyRule struct {
+	KeyRule
+
+	regex  *regexp.Regexp
+	format *regexp.Regexp
+}
+
+// ErrInvalidKeyRule is returned when a key rule is missing a parameter or has a bad regex.
+var ErrInvalidKeyRule = errors.New("invalid key rule")
+
+// defaultKeyRules match X-Api-Key, then segment 5 of the uri path, like the website does.
+//
+//nolint:gochecknoglobals // compiled once, read-only.
+var defaultKeyRules = mustKeyRules([]*KeyRule{
+	{Type: KeyRuleHeader, Header: HeaderXAPIKey},
+	{Type: KeyRulePath, Segment: keyPosition},
+})
+
+func mustKeyRules(rules []*KeyRule) []*keyRule {
+	compiled, err := newKeyRules(rules)
+	if err != nil {
+		panic(err)
+	}
+
+	return compiled
+}
+
+// newKeyRules validates and compiles the configured key rules. No rules returns nil, and findKey uses the default rules.
+func newKeyRules(rules []*KeyRule) ([]*keyRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	compiled := make([]*keyRule, len(rules))
+
+	for idx, rule := range rules {
+		var err error
+		if compiled[idx], err = newKeyRule(*rule); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", idx+1, err)
+		}
+	}
+
+	return compiled, nil
+}
+
+func newKeyRule(rule KeyRule) (*keyRule, error) { //nolint:cyclop
+	rule.Type = strings.ToLower(rule.Type)
+	compiled := &keyRule{KeyRule: rule}
+	param := ""
+
+	switch rule.Type {
+	case KeyRuleBearer, KeyRuleBasicUser, KeyRuleBasicPassword:
+	case KeyRuleHeader:
+		if rule.Header == "" {
+			return nil, fmt.Errorf("%w: header type requires a header name", ErrInvalidKeyRule)
+		}
+
+		compiled.Header = http.CanonicalHeaderKey(rule.Header)
+		param = compiled.Header
+	case KeyRuleQuery:
+		if rule.Param == "" {
+			return nil, fmt.Errorf("%w: query type requires a param name", ErrInvalidKeyRule)
+		}
+
+		param = rule.Param
+	case KeyRulePath:
+		if rule.Segment < 1 {
+			return nil, fmt.Errorf("%w: path type requires a segment greater than 0", ErrInvalidKeyRule)
+		}
+
+		param = strconv.Itoa(rule.Segment)
+	case KeyRuleRegex:
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: regex: %w", ErrInvalidKeyRule, err)
+		} else if regex.NumSubexp() < 1 {
+			return nil, fmt.Errorf("%w: regex requires a capture group", ErrInvalidKeyRule)
+		}
+
+		compiled.regex = regex
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidKeyRule, rule.Type)
+	}
+
+	if rule.Format != "" {
+		format, err := regexp.Compile("^(?:" + rule.Format + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%w: format: %w", ErrInvalidKeyRule, err)
+		}
+
+		compiled.format = format
+	}
+
+	if compiled.Length == 0 {
+		compiled.Length = keyLength
+	}
+
+	if compiled.Name == "" {
+		compiled.Name = rule.Type
+		if param != "" {
+			compiled.Name += ":" + param
+		}
+	}
+
+	return compiled, nil
+}
+
+// find returns the candidate key for this rule, which may be empty or invalid.
+func (r *keyRule) find(header http.Header, uri string) string {
+	switch r.Type {
+	case KeyRuleHeader:
+		return getHeader(header, r.Header)
+	case KeyRuleBearer:
+		if token, ok := strings.CutPrefix(getHeader(header, "Authorization"), "Bearer "); ok {
+			return token
+		}
+	case KeyRuleBasicUser, KeyRuleBasicPassword:
+		user, pass, _ := (&http.Request{Header: header}).BasicAuth()
+		if r.Type == KeyRuleBasicUser {
+			return user
+		}
+
+		return pass
+	case KeyRuleQuery:
+		_, query, _ := strings.Cut(uri, "?")
+		values, _ := url.ParseQuery(query)
+
+		return values.Get(r.Param)
+	case KeyRulePath:
+		pathPart, _, _ := strings.Cut(uri, "?")
+		return uriSegment(pathPart, r.Segment)
+	case KeyRuleRegex:
+		if match := r.regex.FindStringSubmatch(uri); match != nil {
+			return match[1]
+		}
+	}
+
+	return ""
+}
+
+// valid returns true if key passes the rule's length and format validation.
+func (r *keyRule) valid(key string) bool {
+	return key != "" && (r.Length < 0 || len(key) == r.Length) && (r.format == nil || r.format.MatchString(key))
+}
+
+// rules returns the configured key rules, or the default rules.
+func (s *server) rules() []*keyRule {
+	if s.keyRules == nil {
+		return defaultKeyRules
+	}
+
+	return s.keyRules
+}
+
+// findKey runs the key rules against a request's headers and uri. It returns the key and the name of the
+// rule that matched it. When no rule finds a valid key, it returns an empty key, the "none" rule, and false.
+// Invalid candidates are not returned, because they may be a password or token from another header.
+func (s *server) findKey(header http.Header, uri string) (string, string, bool) {
+	for _, rule := range s.rules() {
+		if key := rule.find(header, uri); rule.valid(key) {
+			return key, rule.Name, true
+		}
+	}
+
+	return "", keyRuleNone, false
+}
+
+// keyStart returns the index in pathPart where this rule's key starts, and true, if the rule
+// finds a key in the uri path. Only path and regex rules read keys from the path.
+func (r *keyRule) keyStart(pathPart, uri string) (int, bool) {
+	switch r.Type {
+	case KeyRulePath:
+		pos := 0
+		segIdx := 0
+
+		for seg := range strings.SplitSeq(pathPart, "/") {
+			if segIdx == r.Segment {
+				return pos, true
+			}
+
+			pos += len(seg) + 1
+			segIdx++
+		}
+	case KeyRuleRegex:
+		if match := r.regex.FindStringSubmatchIndex(uri); match != nil && match[2] >= 0 && match[2] < len(pathPart) {
+			return match[2], true
+		}
+	}
+
+	return 0, false
+}
+
+// redactedPath returns the path part of X-Original-Uri (no query string) truncated before the first
+// key that any path or regex rule finds in it. This keeps keys out of the access log and trace spans.
+// No rules uses the default rules. When X-Original-Uri is missing, empty, or only a query string, it returns "".
+func redactedPath(rules []*keyRule, header http.Header) string {
+	if rules == nil {
+		rules = defaultKeyRules
+	}
+
+	uri := getHeader(header, HeaderXOriginalURI)
+	pathPart, _, _ := strings.Cut(uri, "?")
+
+	if pathPart == "" {
+		return ""
+	}
+
+	end, found := len(pathPart), false
+
+	for _, rule := range rules {
+		if start, ok := rule.keyStart(pathPart, uri); ok && start <= end {
+			end, found = start, true
+		}
+	}
+
+	if !found {
+		return pathPart
+	}
+
+	return strings.TrimSuffix(pathPart[:end], "/")
+}
@@ -0,0 +1,151 @@
+//nolint:testpackage // Tests unexported key rules.
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFindKey(t *testing.T) {
+	t.Parallel()
+
+	apiKey := TestAccessLogAPIKey
+
+	rules, err := newKeyRules([]*KeyRule{
+		{Type: "header", Header: "x-token"},
+		{Type: KeyRuleBearer},
+		{Type: KeyRuleBasicPassword},
+		{Type: KeyRuleQuery, Param: "apikey"},
+		{Type: KeyRuleRegex, Regex: `^/v2/keys/([^/?]+)`, Name: "v2"},
+		{Type: KeyRulePath, Segment: 3, Length: 8, Format: "[0-9]+"},
+	})
+	if err != nil {
+		t.Fatalf("newKeyRules: %v", err)
+	}
+
+	srv := &server{Config: &Config{}, keyRules: rules}
+	basic := httptest.NewRequest(http.MethodGet, "/", nil)
+	basic.SetBasicAuth("user", apiKey)
+
+	password := httptest.NewRequest(http.MethodGet, "/", nil)
+	password.SetBasicAuth("user", "hunter2")
+
+	tests := []struct {
+		name   string
+		header http.Header
+		uri    string
+		key    string
+		rule   string
+	}{
+		{"header", http.Header{"X-Token": {apiKey}}, "", apiKey, "header:X-Token"},
+		{"bearer", http.Header{"Authorization": {"Bearer " + apiKey}}, "", apiKey, "bearer"},
+		{"basic", basic.Header, "", apiKey, "basic_password"},
+		{"query", nil, "/api/v3/thing?x=1&apikey=" + apiKey, apiKey, "query:apikey"},
+		{"regex", nil, "/v2/keys/" + apiKey + "?x=1", apiKey, "v2"},
+		{"path", nil, "/api/v1/12345678/method", "12345678", "path:3"},
+		{"path format", nil, "/api/v1/1234567a/method", "", keyRuleNone},
+		{"invalid basic password", password.Header, "/api/v1/bad", "", keyRuleNone},
+		{"short header falls through", http.Header{"X-Token": {"short"}}, "/api/v3?apikey=" + apiKey, apiKey, "query:apikey"},
+		{"nothing", nil, "/", "", keyRuleNone},
+	}
+
+	for _, test := range tests {
+		key, rule, found := srv.findKey(test.header, test.uri)
+		if key != test.key || rule != test.rule || found != (rule != keyRuleNone) {
+			t.Errorf("%s: got key %q rule %q found %v, want key %q rule %q", test.name, key, rule, found, test.key, test.rule)
+		}
+	}
+}
+
+func TestFindKey_defaultRules(t *testing.T) {
+	t.Parallel()
+
+	apiKey := TestAccessLogAPIKey
+	srv := &server{Config: &Config{}}
+
+	key, rule, _ := srv.findKey(http.Header{HeaderXAPIKey: {apiKey}}, "")
+	if key != apiKey || rule != "header:X-Api-Key" {
+		t.Fatalf("header: got %q %q", key, rule)
+	}
+
+	key, rule, _ = srv.findKey(nil, "/api/v1/route/method/"+apiKey+"?x=1")
+	if key != apiKey || rule != "path:5" {
+		t.Fatalf("path: got %q %q", key, rule)
+	}
+
+	// Without a valid key, nothing is returned (or echoed on a 401).
+	if key, _, found := srv.findKey(http.Header{HeaderXAPIKey: {"short"}}, "/api/v1/route/method/bad"); key != "" || found {
+		t.Fatalf("invalid keys: got %q, want empty", key)
+	}
+}
+
+func TestRedactedPath(t *testing.T) {
+	t.Parallel()
+
+	apiKey := TestAccessLogAPIKey
+
+	rules, err := newKeyRules([]*KeyRule{
+		{Type: KeyRuleHeader, Header: HeaderXAPIKey},
+		{Type: KeyRulePath, Segment: 3},
+		{Type: KeyRuleRegex, Regex: `^/v2/key=([^/?]+)`},
+	})
+	if err != nil {
+		t.Fatalf("newKeyRules: %v", err)
+	}
+
+	for uri, want := range map[string]string{
+		"/api/v3/" + apiKey + "/method?x=1": "/api/v3",
+		"/v2/key=" + apiKey:                 "/v2/key=",
+		"/v2/key=" + apiKey + "/x/y":        "/v2/key=",
+		"/api":                              "/api",
+		"?x=" + apiKey:                      "",
+	} {
+		if got := redactedPath(rules, http.Header{HeaderXOriginalURI: {uri}}); got != want {
+			t.Errorf("%s: got %q, want %q", uri, got, want)
+		}
+	}
+
+	// No rules uses the default rules, which cut before segment 5.
+	if got := redactedPath(nil, http.Header{HeaderXOriginalURI: {"/api/v1/route/method/" + apiKey}}); got != "/api/v1/route/method" {
+		t.Errorf("default rules: got %q", got)
+	}
+}
+
+func TestNewKeyRules_invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, rule := range []*KeyRule{
+		{Type: "cookie"},
+		{Type: KeyRuleHeader},
+		{Type: KeyRuleQuery},
+		{Type: KeyRulePath},
+		{Type: KeyRuleRegex, Regex: "no-capture-group"},
+		{Type: KeyRuleRegex, Regex: "(unclosed"},
+		{Type: KeyRuleBearer, Format: "[bad"},
+	} {
+		if _, err := newKeyRules([]*KeyRule{rule}); !errors.Is(err, ErrInvalidKeyRule) {
+			t.Errorf("%+v: err = %v, want ErrInvalidKeyRule", rule, err)
+		}
+	}
+}
+
+func TestAccessLog_redactsConfiguredKey(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	srv.keyRules, _ = newKeyRules([]*KeyRule{{Type: KeyRulePath, Segment: 3}})
+
+	buf := &bytes.Buffer{}
+	handler := srv.accessLogWrap(srv.traceAuth(srv.handleAuth), buf, LogFormatJSON)
+	handler.ServeHTTP(httptest.NewRecorder(), authRequest(map[string]string{
+		HeaderXOriginalURI: "/api/v3/" + TestAccessLogAPIKey + "/method",
+	}))
+
+	if strings.Contains(buf.String(), TestAccessLogAPIKey) || !strings.Contains(buf.String(), `"referer":"/api/v3"`) {
+		t.Fatalf("access log shows the key: %s", buf.String())
+	}
+}
@@ -0,0 +1,357 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* This file contains the syslog and json log targets, and the buffered writer in front of them. */
+
+// Log targets for the access log (log_target) and the error log (error_target).
+// Remote syslog targets are written as udp://host:port or tcp://host:port.
+const (
+	LogTargetFile   = "file"   // log_file or error_file, rotated. Default when the file is set.
+	LogTargetStdout = "stdout" // plain lines on stdout (access) or stderr (error). Default without a file.
+	LogTargetJSON   = "json"   // JSON lines on stdout, for both logs.
+	LogTargetSyslog = "syslog" // RFC5424 messages to the local syslog socket.
+)
+
+// Log names. Used as the syslog MSGID, the json log field and the dropped lines metric label.
+const (
+	logAccess = "access"
+	logError  = "error"
+)
+
+const (
+	defaultLogBuffer     = 1024
+	defaultSyslogTag     = "authproxy"
+	syslogFacility       = 16 // local0.
+	syslogSeverityInfo   = 6
+	syslogSeverityNotice = 5
+	syslogWriteTimeout   = 5 * time.Second
+)
+
+// ErrInvalidLogTarget is returned when a log or error target is unknown, or missing its file.
+var ErrInvalidLogTarget = errors.New("invalid log target")
+
+// errLogClosed is returned when writing to a buffered log target after it was closed.
+var errLogClosed = errors.New("log target closed")
+
+//nolint:gochecknoglobals // same list as log/syslog.
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// checkLogTargets normalizes and validates the access and error log targets.
+func (c *Config) checkLogTargets() error {
+	var err error
+
+	if c.LogTarget, err = checkLogTarget(c.LogTarget, c.LogFile); err != nil {
+		return fmt.Errorf("log_target: %w", err)
+	}
+
+	if c.ErrorTarget, err = checkLogTarget(c.ErrorTarget, c.ErrorFile); err != nil {
+		return fmt.Errorf("error_target: %w", err)
+	}
+
+	if c.LogBuffer <= 0 {
+		c.LogBuffer = defaultLogBuffer
+	}
+
+	if c.SyslogTag == "" {
+		c.SyslogTag = defaultSyslogTag
+	}
+
+	return nil
+}
+
+func checkLogTarget(target, file string) (string, error) {
+	switch lower := strings.ToLower(target); lower {
+	case "":
+		if file != "" {
+			return LogTargetFile, nil
+		}
+
+		return LogTargetStdout, nil
+	case LogTargetFile:
+		if file == "" {
+			return "", fmt.Errorf("%w: file target requires a file", ErrInvalidLogTarget)
+		}
+
+		return lower, nil
+	case LogTargetStdout, LogTargetJSON, LogTargetSyslog:
+		return lower, nil
+	}
+
+	network, addr, err := remoteSyslog(target)
+	if err != nil {
+		return "", err
+	}
+
+	return network + "://" + addr, nil
+}
+
+// remoteSyslog parses a udp://host:port or tcp://host:port target.
+func remoteSyslog(target string) (string, string, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s: %w", ErrInvalidLogTarget, target, err)
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	if (scheme != "udp" && scheme != "tcp") || parsed.Port() == "" {
+		return "", "", fmt.Errorf("%w: %s: use file, stdout, json, syslog, udp://host:port or tcp://host:port",
+			ErrInvalidLogTarget, target)
+	}
+
+	return scheme, parsed.Host, nil
+}
+
+// newLogTarget returns the buffered writer for a json or syslog log target.
+func (s *server) newLogTarget(target, name string) (*asyncWriter, error) {
+	if target == LogTargetJSON {
+		return newAsyncWriter(&jsonWriter{dst: os.Stdout, log: name}, s.LogBuffer, s.droppedLine(name)), nil
+	}
+
+	severity := syslogSeverityInfo
+	if name == logError {
+		severity = syslogSeverityNotice
+	}
+
+	writer, err := newSyslogWriter(target, s.SyslogTag, name, severity)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAsyncWriter(writer, s.LogBuffer, s.droppedLine(name)), nil
+}
+
+// droppedLine returns the callback that counts a dropped line. Metrics are set up after the logs.
+func (s *server) droppedLine(name string) func() {
+	return func() { s.metrics.CountLogDropped(name) }
+}
+
+// asyncWriter buffers lines in a channel and writes them to dst in the background,
+// so a slow log target never delays a request. Lines are dropped when the buffer is full.
+type asyncWriter struct {
+	dst     io.Writer
+	lines   chan []byte
+	done    chan struct{}
+	dropped func()
+	mu      sync.RWMutex // protects closed, and lines from being closed during a send.
+	closed  bool
+}
+
+func newAsyncWriter(dst io.Writer, size int, dropped func()) *asyncWriter {
+	writer := &asyncWriter{
+		dst:     dst,
+		lines:   make(chan []byte, size),
+		done:    make(chan struct{}),
+		dropped: dropped,
+	}
+
+	go writer.run()
+
+	return writer
+}
+
+func (a *asyncWriter) run() {
+	defer close(a.done)
+
+	for line := range a.lines {
+		_, _ = a.dst.Write(line) // nowhere to report this.
+	}
+}
+
+// Write queues a copy of p. It never blocks.
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return 0, errLogClosed
+	}
+
+	select {
+	case a.lines <- bytes.Clone(p):
+	default:
+		a.dropped()
+	}
+
+	return len(p), nil
+}
+
+// Close writes the queued lines, then closes dst if it is a closer.
+func (a *asyncWriter) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+
+	a.closed = true
+	close(a.lines)
+	a.mu.Unlock()
+	<-a.done
+
+	if closer, ok := a.dst.(io.Closer); ok {
+		return closer.Close() //nolint:wrapcheck // the caller knows which log this is.
+	}
+
+	return nil
+}
+
+// jsonWriter writes every line as a JSON object. Lines that already are JSON objects, like the
+// json access log format, are written as they are. Others are wrapped with the time and log name.
+type jsonWriter struct {
+	dst io.Writer
+	log string
+}
+
+func (j *jsonWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\n")
+	if bytes.HasPrefix(line, []byte("{")) && bytes.HasSuffix(line, []byte("}")) {
+		return j.dst.Write(append(line, '\n')) //nolint:wrapcheck // delegate to the underlying writer.
+	}
+
+	builder := &strings.Builder{}
+	builder.WriteString(`{"time":"`)
+	builder.WriteString(time.Now().Format(time.RFC3339Nano))
+	builder.WriteString(`","log":"`)
+	builder.WriteString(j.log)
+	builder.WriteString(`","msg":`)
+	writeQuoted(builder, string(line))
+	builder.WriteString("}\n")
+
+	return io.WriteString(j.dst, builder.String()) //nolint:wrapcheck // delegate to the underlying writer.
+}
+
+// syslogWriter writes every line as an RFC5424 message to a syslog socket.
+// It reconnects once when a write fails.
+type syslogWriter struct {
+	network  string // udp or tcp for a remote server. Empty for the local socket.
+	addr     string
+	priority string
+	header   string // everything between the timestamp and the message.
+	conn     net.Conn
+	connNet  string // the network conn was dialed with.
+}
+
+func newSyslogWriter(target, tag, msgID string, severity int) (*syslogWriter, error) {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	writer := &syslogWriter{
+		priority: "<" + strconv.Itoa(syslogFacility*8+severity) + ">1 ",
+		header:   " " + hostname + " " + tag + " " + strconv.Itoa(os.Getpid()) + " " + msgID + " - ",
+	}
+
+	if target != LogTargetSyslog {
+		writer.network, writer.addr, _ = remoteSyslog(target)
+	}
+
+	if err := writer.connect(); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// connect dials the remote syslog server, or the first local syslog socket that answers.
+func (w *syslogWriter) connect() error {
+	var err error
+
+	if w.network != "" {
+		if w.conn, err = net.DialTimeout(w.network, w.addr, syslogWriteTimeout); err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+
+		w.connNet = w.network
+
+		return nil
+	}
+
+	for _, path := range localSyslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			if w.conn, err = net.Dial(network, path); err == nil {
+				w.connNet = network
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("syslog: no local syslog socket: %w", err)
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	err := w.send(p)
+	if err != nil { // reconnect once.
+		if w.conn != nil {
+			_ = w.conn.Close()
+			w.conn = nil
+		}
+
+		if err = w.connect(); err == nil {
+			err = w.send(p)
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *syslogWriter) send(p []byte) error {
+	if w.conn == nil {
+		return net.ErrClosed
+	}
+
+	_ = w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+
+	if _, err := w.conn.Write(w.format(p)); err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+
+	return nil
+}
+
+// format returns the RFC5424 message for a line, framed for the connection's transport:
+// octet counting over tcp, a newline over a unix stream, and nothing for datagrams.
+func (w *syslogWriter) format(p []byte) []byte {
+	const timestamp = "2006-01-02T15:04:05.000000Z07:00"
+
+	line := bytes.TrimRight(p, "\n")
+	msg := make([]byte, 0, len(w.priority)+len(timestamp)+len(w.header)+len(line)+1)
+	msg = append(msg, w.priority...)
+	msg = time.Now().AppendFormat(msg, timestamp)
+	msg = append(msg, w.header...)
+	msg = append(msg, line...)
+
+	switch w.connNet {
+	case "tcp":
+		return append(strconv.AppendInt(nil, int64(len(msg)), 10), append([]byte{' '}, msg...)...)
+	case "unix":
+		return append(msg, '\n')
+	default:
+		return msg
+	}
+}
+
+func (w *syslogWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+
+	return w.conn.Close() //nolint:wrapcheck // the caller knows which log this is.
+}
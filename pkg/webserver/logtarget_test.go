@@ -0,0 +1,197 @@
+//nolint:testpackage // Tests the unexported log targets.
+package webserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckLogTargets(t *testing.T) {
+	t.Parallel()
+
+	config := &Config{LogFile: "/logs/access.log", ErrorTarget: "UDP://syslog:514"}
+	if err := config.checkLogTargets(); err != nil {
+		t.Fatalf("checkLogTargets: %v", err)
+	}
+
+	if config.LogTarget != LogTargetFile || config.ErrorTarget != "udp://syslog:514" ||
+		config.LogBuffer != defaultLogBuffer || config.SyslogTag != defaultSyslogTag {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+
+	for _, target := range []string{"kafka", "udp://syslog", "http://syslog:514", LogTargetFile} {
+		if err := (&Config{ErrorTarget: target}).checkLogTargets(); !errors.Is(err, ErrInvalidLogTarget) {
+			t.Errorf("%s: err = %v, want ErrInvalidLogTarget", target, err)
+		}
+	}
+}
+
+// blockingWriter blocks every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+	lines   atomic.Int32
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.release
+	b.lines.Add(1)
+
+	return len(p), nil
+}
+
+func TestAsyncWriter_dropsWhenFull(t *testing.T) {
+	t.Parallel()
+
+	var dropped atomic.Int32
+
+	dst := &blockingWriter{release: make(chan struct{})}
+	writer := newAsyncWriter(dst, 2, func() { dropped.Add(1) })
+
+	start := time.Now()
+	for range 10 {
+		if _, err := writer.Write([]byte("line\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("writes blocked for %v", elapsed)
+	}
+
+	close(dst.release)
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// One line may be held by the writer goroutine, plus the two buffered.
+	if written, drops := dst.lines.Load(), dropped.Load(); written+drops != 10 || written > 3 {
+		t.Fatalf("written %d, dropped %d; want 10 total with at most 3 written", written, drops)
+	}
+
+	if _, err := writer.Write([]byte("late\n")); !errors.Is(err, errLogClosed) {
+		t.Fatalf("write after close: err = %v, want errLogClosed", err)
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	t.Parallel()
+
+	var buf strings.Builder
+
+	writer := &jsonWriter{dst: &buf, log: logError}
+	_, _ = writer.Write([]byte("database \"down\"\n"))
+	_, _ = writer.Write([]byte(`{"already":"json"}` + "\n"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 || lines[1] != `{"already":"json"}` {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+
+	var wrapped map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &wrapped); err != nil {
+		t.Fatalf("invalid json: %v: %q", err, lines[0])
+	}
+
+	if wrapped["log"] != logError || wrapped["msg"] != `database "down"` || wrapped["time"] == "" {
+		t.Fatalf("unexpected wrapped line: %v", wrapped)
+	}
+}
+
+// rfc5424 matches a message from newSyslogWriter: local0, version 1, and a nil structured data.
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S+ \S+ authproxy \d+ (\w+) - (.*)$`)
+
+func TestSyslogWriter_udp(t *testing.T) {
+	t.Parallel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+
+	writer, err := newSyslogWriter("udp://"+conn.LocalAddr().String(), defaultSyslogTag, logAccess, syslogSeverityInfo)
+	if err != nil {
+		t.Fatalf("newSyslogWriter: %v", err)
+	}
+	defer writer.Close()
+
+	if _, err := writer.Write([]byte("GET /auth 200\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	size, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	match := rfc5424.FindStringSubmatch(string(buf[:size]))
+	if match == nil || match[1] != "134" || match[2] != logAccess || match[3] != "GET /auth 200" {
+		t.Fatalf("unexpected message: %q", buf[:size])
+	}
+}
+
+func TestSyslogWriter_tcpOctetCounting(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	writer, err := newSyslogWriter("tcp://"+listener.Addr().String(), defaultSyslogTag, logError, syslogSeverityNotice)
+	if err != nil {
+		t.Fatalf("newSyslogWriter: %v", err)
+	}
+	defer writer.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	for _, line := range []string{"first\n", "second line\n"} {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	for _, want := range []string{"first", "second line"} {
+		prefix, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatalf("reading frame length: %v", err)
+		}
+
+		length, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+		if err != nil {
+			t.Fatalf("frame length %q: %v", prefix, err)
+		}
+
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(reader, msg); err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+
+		match := rfc5424.FindStringSubmatch(string(msg))
+		if match == nil || match[1] != "133" || match[2] != logError || match[3] != want {
+			t.Fatalf("unexpected message: %q", msg)
+		}
+	}
+}
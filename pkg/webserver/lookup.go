@@ -0,0 +1,132 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"golift.io/cache"
+)
+
+/* This file contains the backend lookup, cache expiration and background refresh logic. */
+
+// fetch queries the backend for a key through lookup, collapsing concurrent requests for the same
+// cache label and key into one query. The query is detached from the caller's cancellation so one
+// cancelled request does not fail every request waiting on the same key.
+func (s *server) fetch(ctx context.Context, keyReq keyReq) (*userinfo.UserInfo, error) {
+	leader := false
+
+	result, err, _ := s.flights.Do(keyReq.label+":"+keyReq.key, func() (any, error) {
+		leader = true
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+
+		return s.lookup(ctx, keyReq)
+	})
+
+	if !leader {
+		s.metrics.Deduplicated.WithLabelValues(keyReq.label).Inc()
+	}
+
+	user, _ := result.(*userinfo.UserInfo)
+
+	return user, err //nolint:wrapcheck // the error is already wrapped in lookup.
+}
+
+// lookup queries the backend for a key and saves the result to the cache.
+// Database errors are not cached, and the returned user is nil.
+func (s *server) lookup(ctx context.Context, keyReq keyReq) (*userinfo.UserInfo, error) {
+	ctx, span := s.traceLookup(ctx, keyReq)
+	user, err := keyReq.get(ctx, keyReq.key)
+
+	if errors.Is(err, userinfo.ErrNoUser) {
+		endSpan(span, nil) // a missing user is not a failed query.
+	} else {
+		endSpan(span, err)
+	}
+
+	switch {
+	case errors.Is(err, userinfo.ErrNoUser):
+		keyReq.save(keyReq.key, user, cache.Options{Prune: true}) // save the "default user" to the cache.
+		s.deleteStale(keyReq.label, keyReq.key)                   // a revoked key must not be served stale.
+	case err != nil:
+		s.Printf("[ERROR] %v", err) // database error.
+	default:
+		now := time.Now()
+		keyReq.save(keyReq.key, user, s.validUserOptions(now)) // save the valid user to the cache.
+		s.saveStale(keyReq.label, keyReq.key, user, now)
+	}
+
+	return user, err
+}
+
+// staleKey returns the key for a user or server in the stale store.
+func staleKey(label, key string) string {
+	return label + ":" + key
+}
+
+// saveStale keeps a copy of a valid user in the stale store for StaleMaxAge after when it was saved.
+func (s *server) saveStale(label, key string, user *userinfo.UserInfo, when time.Time) {
+	if s.stale == nil {
+		return
+	}
+
+	s.stale.Save(staleKey(label, key), user, cache.Options{Expire: when.Add(s.StaleMaxAge)})
+}
+
+// staleUser returns a user from the stale store, and when it was saved, if it is younger than StaleMaxAge.
+func (s *server) staleUser(keyReq keyReq) (*userinfo.UserInfo, time.Time, bool) {
+	if s.stale == nil {
+		return nil, time.Time{}, false
+	}
+
+	user, when, ok := cacheUserFromGetInto(s.stale, staleKey(keyReq.label, keyReq.key))
+	if !ok || time.Since(when) > s.StaleMaxAge {
+		return nil, time.Time{}, false
+	}
+
+	return user, when, true
+}
+
+// deleteStale removes a user or server from the stale store so deleted entries are never served.
+func (s *server) deleteStale(label, key string) {
+	if s.stale != nil {
+		s.stale.Delete(staleKey(label, key))
+	}
+}
+
+// validUserOptions returns the cache options for a valid user. Valid users are never pruned,
+// but they expire after CacheMaxAge when it is set.
+func (s *server) validUserOptions(now time.Time) cache.Options {
+	if s.CacheMaxAge <= 0 {
+		return cache.Options{Prune: false}
+	}
+
+	return cache.Options{Prune: false, Expire: now.Add(s.CacheMaxAge)}
+}
+
+// cacheExpired returns true if a cached valid user is older than CacheMaxAge.
+// The pruner removes expired items eventually; this catches them before it runs.
+func (s *server) cacheExpired(user *userinfo.UserInfo, when, now time.Time) bool {
+	return s.CacheMaxAge > 0 && user.UserID != userinfo.DefaultUserID && now.Sub(when) > s.CacheMaxAge
+}
+
+// refreshIfStale starts a background refresh for a cached valid user older than CacheRefresh.
+// The cached user is served immediately; only one refresh per key runs at a time.
+func (s *server) refreshIfStale(keyReq keyReq, user *userinfo.UserInfo, when, now time.Time) {
+	if s.CacheRefresh <= 0 || user.UserID == userinfo.DefaultUserID || now.Sub(when) < s.CacheRefresh {
+		return
+	}
+
+	flight := keyReq.label + ":" + keyReq.key
+	if _, running := s.refreshing.LoadOrStore(flight, struct{}{}); running {
+		return
+	}
+
+	s.background.Go(func() {
+		defer s.refreshing.Delete(flight)
+		_, _ = s.fetch(context.Background(), keyReq) // errors keep the cached user in place.
+	})
+}
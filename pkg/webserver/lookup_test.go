@@ -0,0 +1,161 @@
+//nolint:testpackage // Tests unexported cache lookup helpers.
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golift.io/cache"
+)
+
+func TestHandleAuth_cacheMaxAge(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, &Config{CacheMaxAge: 20 * time.Millisecond})
+	request := authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey})
+
+	srv.handleAuth(httptest.NewRecorder(), request)
+	srv.handleAuth(httptest.NewRecorder(), request)
+
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Fatalf("backend calls before max age = %d, want 1", calls)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	srv.handleAuth(httptest.NewRecorder(), request)
+
+	if calls := backend.calls.Load(); calls != 2 {
+		t.Fatalf("backend calls after max age = %d, want 2", calls)
+	}
+}
+
+func TestHandleAuth_cacheRefresh(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, &Config{CacheRefresh: 10 * time.Millisecond})
+	request := authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey})
+
+	srv.handleAuth(httptest.NewRecorder(), request)
+
+	backend.mu.Lock()
+	backend.users[TestAccessLogAPIKey].Environment = "beta"
+	backend.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, request)
+
+	if rec.Code != http.StatusOK || rec.Header().Get(HeaderEnvironment) != "dev" {
+		t.Fatalf("stale entry: status = %d, env = %q, want 200 dev", rec.Code, rec.Header().Get(HeaderEnvironment))
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for user, _, _ := cacheUserFromGetInto(srv.users, TestAccessLogAPIKey); user.Environment != "beta"; {
+		if time.Now().After(deadline) {
+			t.Fatal("cached user was not refreshed in the background")
+		}
+
+		time.Sleep(time.Millisecond)
+		user, _, _ = cacheUserFromGetInto(srv.users, TestAccessLogAPIKey)
+	}
+
+	if calls := backend.calls.Load(); calls != 2 {
+		t.Fatalf("backend calls = %d, want 2", calls)
+	}
+}
+
+func TestHandleAuth_coalescesConcurrentMisses(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, nil)
+	backend.delay = 100 * time.Millisecond
+
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Go(func() {
+			rec := httptest.NewRecorder()
+			srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", rec.Code)
+			}
+		})
+	}
+
+	wg.Wait()
+
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Fatalf("backend calls = %d, want 1", calls)
+	}
+}
+
+func TestHandleAuth_serveStaleOnDatabaseError(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, &Config{CacheMaxAge: time.Millisecond, StaleMaxAge: time.Hour})
+	srv.stale = cache.New(cache.Config{})
+	t.Cleanup(func() { srv.stale.Stop(false) })
+
+	request := authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey})
+	srv.handleAuth(httptest.NewRecorder(), request)
+
+	time.Sleep(5 * time.Millisecond) // expire the cached user.
+	backend.setErr(errFakeDB)
+
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, request)
+
+	if rec.Code != http.StatusOK || rec.Header().Get(HeaderEnvironment) != "dev" {
+		t.Fatalf("status = %d, env = %q, want 200 dev", rec.Code, rec.Header().Get(HeaderEnvironment))
+	}
+
+	if rec.Header().Get(HeaderXAuthStale) != "1" {
+		t.Fatal("expected stale header on a stale serve")
+	}
+
+	// Deleted keys must not be served from the stale store.
+	del := httptest.NewRequestWithContext(context.Background(), http.MethodDelete, "/auth", nil)
+	del.Header.Set(HeaderXAPIKeys, TestAccessLogAPIKey)
+	srv.handleAuth(httptest.NewRecorder(), del)
+
+	rec = httptest.NewRecorder()
+	srv.handleAuth(rec, request)
+
+	if rec.Header().Get(HeaderXAuthStale) != "" || rec.Header().Get(HeaderEnvironment) != "live" {
+		t.Fatalf("deleted key served stale: env = %q", rec.Header().Get(HeaderEnvironment))
+	}
+}
+
+func TestHandleAuth_revokedKeyNotServedStale(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, &Config{CacheMaxAge: time.Millisecond, StaleMaxAge: time.Hour})
+	srv.stale = cache.New(cache.Config{})
+	t.Cleanup(func() { srv.stale.Stop(false) })
+
+	request := authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey})
+	srv.handleAuth(httptest.NewRecorder(), request)
+
+	// The key is revoked in the database, and the revocation is looked up once the cached user expires.
+	backend.mu.Lock()
+	delete(backend.users, TestAccessLogAPIKey)
+	backend.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	srv.handleAuth(httptest.NewRecorder(), request)
+
+	srv.users.Delete(TestAccessLogAPIKey) // prune the cached default user.
+	backend.setErr(errFakeDB)
+
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, request)
+
+	if rec.Header().Get(HeaderXAuthStale) != "" || rec.Header().Get(HeaderXUserid) == "1001" {
+		t.Fatalf("revoked key served stale while the database is down: user id = %q", rec.Header().Get(HeaderXUserid))
+	}
+}
@@ -0,0 +1,410 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"golift.io/cache"
+)
+
+/* This file contains the per-key and per-user token bucket rate limiter for auth requests. */
+
+// Rate limit subjects.
+const (
+	RateLimitByKey  = "key"  // one bucket per API key.
+	RateLimitByUser = "user" // one bucket per user ID, shared by all of the user's keys.
+)
+
+const (
+	defaultRateLimitPer = time.Minute
+	bucketPruneInterval = time.Minute
+	rateLimitQuota      = "quota" // name of the limit built from a user's rate_limit and rate_period columns.
+)
+
+// Rate limit response headers. X-Ratelimit-* are set on every rate limited user auth response,
+// and Retry-After on throttled responses, in seconds.
+const (
+	HeaderRetryAfter          = "Retry-After"
+	HeaderXRateLimitLimit     = "X-Ratelimit-Limit"
+	HeaderXRateLimitRemaining = "X-Ratelimit-Remaining"
+	HeaderXRateLimitReset     = "X-Ratelimit-Reset"
+)
+
+// RateLimitConfig configures token bucket rate limiting of user auth requests. State is in memory, per instance.
+// Server (X-Server) lookups are not rate limited. Besides Limits, a user's rate_tier column selects one of Tiers,
+// and a user's rate_limit and rate_period columns are a per-user quota that replaces the tier.
+type RateLimitConfig struct {
+	// Status is the http status code returned for throttled requests. Default: 403, or 429 in the traefik
+	// and caddy proxy modes, which pass the auth response through to the client.
+	// Nginx auth_request turns any status except 401 and 403 into a 500, so nginx proxy mode only allows those.
+	Status int `json:"status,omitempty" toml:"status" xml:"status"`
+	// Limits that match a request are all applied. The request is throttled when any of them is exhausted.
+	Limits []*RateLimit `json:"limits,omitempty" toml:"limits" xml:"limit"`
+	// Tiers are limits applied to users with a matching rate_tier from the database.
+	Tiers map[string]*RateLimit `json:"tiers,omitempty" toml:"tiers" xml:"tiers"`
+}
+
+// RateLimit is one token bucket limit.
+type RateLimit struct {
+	// Name is the metric label for this limit. Default: by, environment and path prefix, e.g. key:live:/api.
+	Name string `json:"name,omitempty" toml:"name" xml:"name"`
+	// By is key or user. Default: key.
+	By string `json:"by,omitempty" toml:"by" xml:"by"`
+	// Environment only applies this limit to users in this environment. Empty matches every environment.
+	Environment string `json:"environment,omitempty" toml:"environment" xml:"environment"`
+	// PathPrefix only applies this limit to request uris with this prefix. Empty matches every path.
+	PathPrefix string `json:"pathPrefix,omitempty" toml:"path_prefix" xml:"path_prefix"`
+	// Requests is the number of requests allowed every Per.
+	Requests int `json:"requests" toml:"requests" xml:"requests"`
+	// Per is the duration Requests are allowed in. Default: 1m.
+	Per time.Duration `json:"per,omitempty" toml:"per" xml:"per"`
+	// Burst is the bucket size. Default: Requests.
+	Burst int `json:"burst,omitempty" toml:"burst" xml:"burst"`
+}
+
+// ErrInvalidRateLimit is returned when a rate limit has no requests or an unknown subject.
+var ErrInvalidRateLimit = errors.New("invalid rate limit")
+
+// rateLimiter holds the token buckets for the configured limits.
+type rateLimiter struct {
+	status  int
+	limits  []*RateLimit
+	tiers   map[string]*RateLimit
+	buckets *cache.Cache // buckets expire once they would be full again.
+	mu      sync.Mutex   // serializes bucket creation.
+	now     func() time.Time
+}
+
+// bucket is one token bucket. Tokens refill continuously at the limit's rate, up to its burst.
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// rateDecision is the outcome of applying the rate limits to one request.
+type rateDecision struct {
+	name       string        // the limit that throttled the request, or the tightest limit.
+	limit      int           // burst of the tightest limit.
+	remaining  int           // tokens left in the tightest bucket.
+	reset      time.Duration // until the tightest bucket is full again.
+	retryAfter time.Duration // until the request would be allowed. 0 when allowed.
+}
+
+// newRateLimiter validates the rate limit config. Returns nil when rate limiting is not configured.
+func newRateLimiter(config *RateLimitConfig, proxyMode string) (*rateLimiter, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil // no rate limiter is not an error.
+	}
+
+	limiter := &rateLimiter{status: config.Status, tiers: make(map[string]*RateLimit), now: time.Now}
+
+	switch {
+	case limiter.status == 0 && (proxyMode == ProxyModeTraefik || proxyMode == ProxyModeCaddy):
+		limiter.status = http.StatusTooManyRequests // these proxies pass the auth response to the client.
+	case limiter.status == 0:
+		limiter.status = http.StatusForbidden
+	case proxyMode == ProxyModeNginx && limiter.status != http.StatusUnauthorized && limiter.status != http.StatusForbidden:
+		return nil, fmt.Errorf("%w: status %d becomes a 500 in nginx, use 401 or 403", ErrInvalidRateLimit, limiter.status)
+	}
+
+	for idx, limit := range config.Limits {
+		valid, err := newRateLimit(*limit)
+		if err != nil {
+			return nil, fmt.Errorf("limit %d: %w", idx+1, err)
+		}
+
+		limiter.limits = append(limiter.limits, valid)
+	}
+
+	for name, limit := range config.Tiers {
+		tier := *limit
+		if tier.Name == "" {
+			tier.Name = "tier:" + name
+		}
+
+		valid, err := newRateLimit(tier)
+		if err != nil {
+			return nil, fmt.Errorf("tier %s: %w", name, err)
+		}
+
+		limiter.tiers[name] = valid
+	}
+
+	limiter.buckets = cache.New(cache.Config{
+		PruneInterval:   bucketPruneInterval,
+		MaxUnused:       cache.Forever, // buckets expire when they are full.
+		RequestAccuracy: time.Second,
+	})
+
+	return limiter, nil
+}
+
+func newRateLimit(limit RateLimit) (*RateLimit, error) {
+	switch limit.By = strings.ToLower(limit.By); limit.By {
+	case "":
+		limit.By = RateLimitByKey
+	case RateLimitByKey, RateLimitByUser:
+	default:
+		return nil, fmt.Errorf("%w: unknown by %q, use key or user", ErrInvalidRateLimit, limit.By)
+	}
+
+	if limit.Requests < 1 {
+		return nil, fmt.Errorf("%w: requests must be greater than 0", ErrInvalidRateLimit)
+	}
+
+	if limit.Per <= 0 {
+		limit.Per = defaultRateLimitPer
+	}
+
+	if limit.Burst < 1 {
+		limit.Burst = limit.Requests
+	}
+
+	if limit.Name == "" {
+		limit.Name = strings.Join([]string{limit.By, limit.Environment, limit.PathPrefix}, ":")
+		limit.Name = strings.TrimRight(limit.Name, ":")
+	}
+
+	return &limit, nil
+}
+
+// rate returns the refill rate in tokens per second.
+func (l *RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// matches returns true if the limit applies to this user and request path.
+func (l *RateLimit) matches(user *userinfo.UserInfo, path string) bool {
+	return (l.Environment == "" || l.Environment == user.Environment) && strings.HasPrefix(path, l.PathPrefix)
+}
+
+// all returns the configured limits, followed by the tiers sorted by name.
+func (r *rateLimiter) all() []*RateLimit {
+	limits := slices.Clone(r.limits)
+	for _, name := range slices.Sorted(maps.Keys(r.tiers)) {
+		limits = append(limits, r.tiers[name])
+	}
+
+	return limits
+}
+
+// Stop the bucket pruner.
+func (r *rateLimiter) Stop() {
+	if r != nil {
+		r.buckets.Stop(false)
+	}
+}
+
+// check applies every limit to the user and uri: the configured limits, and the user's quota or tier.
+// A token is taken from each matching bucket only when none of them throttle the request, so a throttled
+// request does not use up the other limits. Returns nil if no limit applies.
+func (r *rateLimiter) check(user *userinfo.UserInfo, uri string) *rateDecision {
+	if r == nil {
+		return nil
+	}
+
+	path, _, _ := strings.Cut(uri, "?")
+	now := r.now()
+
+	var applied []*appliedLimit
+
+	for idx, limit := range r.limits {
+		applied = r.apply(applied, strconv.Itoa(idx), limit, user, path, now)
+	}
+
+	if id, limit := r.userLimit(user); limit != nil {
+		applied = r.apply(applied, id, limit, user, path, now)
+	}
+
+	if len(applied) == 0 {
+		return nil
+	}
+
+	// Buckets are always locked in limit order, so concurrent checks cannot deadlock.
+	for _, item := range applied {
+		item.bucket.mu.Lock()
+		defer item.bucket.mu.Unlock() //nolint:gocritic // every bucket stays locked until the tokens are taken.
+	}
+
+	throttled := false
+
+	for _, item := range applied {
+		item.bucket.refill(item.limit, now)
+		throttled = throttled || item.bucket.tokens < 1
+	}
+
+	var decision *rateDecision
+
+	for _, item := range applied {
+		if !throttled {
+			item.bucket.tokens--
+		}
+
+		current := item.bucket.decision(item.limit, throttled)
+		// Re-save to push the expiration out: the bucket is dropped once it would be full again.
+		r.buckets.Save(item.key, item.bucket, cache.Options{Expire: now.Add(current.reset + time.Second)})
+		decision = worse(decision, current)
+	}
+
+	return decision
+}
+
+// appliedLimit is a limit that matches a request, and the bucket it takes a token from.
+type appliedLimit struct {
+	key    string
+	limit  *RateLimit
+	bucket *bucket
+}
+
+// userLimit returns the bucket id prefix and limit for the user's quota from the database,
+// or for the user's tier. Returns a nil limit if the user has neither.
+func (r *rateLimiter) userLimit(user *userinfo.UserInfo) (string, *RateLimit) {
+	if user.RateLimit > 0 {
+		per := time.Duration(user.RatePeriod) * time.Second
+		if per <= 0 {
+			per = defaultRateLimitPer
+		}
+
+		return rateLimitQuota, &RateLimit{
+			Name:     rateLimitQuota,
+			By:       RateLimitByUser,
+			Requests: user.RateLimit,
+			Per:      per,
+			Burst:    user.RateLimit,
+		}
+	}
+
+	if limit, ok := r.tiers[user.RateTier]; ok {
+		return "tier:" + user.RateTier, limit
+	}
+
+	return "", nil
+}
+
+// apply appends the limit and its bucket for this user to applied, if the limit matches the request path.
+func (r *rateLimiter) apply(
+	applied []*appliedLimit, id string, limit *RateLimit, user *userinfo.UserInfo, path string, now time.Time,
+) []*appliedLimit {
+	if !limit.matches(user, path) {
+		return applied
+	}
+
+	subject := user.APIKey
+	if limit.By == RateLimitByUser {
+		subject = user.UserID
+	}
+
+	key := id + ":" + subject
+
+	return append(applied, &appliedLimit{key: key, limit: limit, bucket: r.bucket(key, limit, now)})
+}
+
+// worse returns the decision to report: the longest wait if throttled,
+// otherwise the limit with the fewest requests remaining.
+func worse(decision, current *rateDecision) *rateDecision {
+	switch {
+	case decision == nil:
+		return current
+	case decision.retryAfter > 0 && current.retryAfter > decision.retryAfter:
+		return current
+	case decision.retryAfter == 0 && (current.retryAfter > 0 || current.remaining < decision.remaining):
+		return current
+	default:
+		return decision
+	}
+}
+
+// bucket returns the bucket for a key, creating a full one if it does not exist.
+func (r *rateLimiter) bucket(key string, limit *RateLimit, now time.Time) *bucket {
+	if item := r.buckets.Get(key); item != nil {
+		if found, ok := item.Data.(*bucket); ok {
+			return found
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if item := r.buckets.Get(key); item != nil { // created while we waited for the lock.
+		if found, ok := item.Data.(*bucket); ok {
+			return found
+		}
+	}
+
+	created := &bucket{tokens: float64(limit.Burst), last: now}
+	r.buckets.Save(key, created, cache.Options{})
+
+	return created
+}
+
+// refill adds the tokens earned since the last request, up to the limit's burst. The caller holds the lock.
+func (b *bucket) refill(limit *RateLimit, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.rate())
+		b.last = now
+	}
+}
+
+// decision reports the bucket's state after a request. When the request was throttled,
+// the buckets with less than one token report how long to wait. The caller holds the lock.
+func (b *bucket) decision(limit *RateLimit, throttled bool) *rateDecision {
+	rate := limit.rate()
+	decision := &rateDecision{
+		name:      limit.Name,
+		limit:     limit.Burst,
+		remaining: int(b.tokens),
+		reset:     seconds((float64(limit.Burst) - b.tokens) / rate),
+	}
+
+	if throttled && b.tokens < 1 {
+		decision.retryAfter = seconds((1 - b.tokens) / rate)
+	}
+
+	return decision
+}
+
+func seconds(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second))
+}
+
+// checkRateLimit applies the rate limits to an allowed user auth result, and sets the X-Ratelimit-* headers.
+// If the request is throttled, Retry-After is also set and the throttled status code is returned.
+// Otherwise it returns 0.
+func (s *server) checkRateLimit(header http.Header, res *authResult, uri string) int {
+	// Denied keys and database errors without a stale user are not counted against anyone.
+	if res.label != "users" || s.limiter == nil || res.user.UserID == userinfo.DefaultUserID || (res.err != nil && !res.stale) {
+		return 0
+	}
+
+	decision := s.limiter.check(res.user, uri)
+	if decision == nil {
+		return 0
+	}
+
+	header.Set(HeaderXRateLimitLimit, strconv.Itoa(decision.limit))
+	header.Set(HeaderXRateLimitRemaining, strconv.Itoa(decision.remaining))
+	header.Set(HeaderXRateLimitReset, ceilSeconds(decision.reset))
+
+	if decision.retryAfter <= 0 {
+		return 0
+	}
+
+	s.metrics.CountRateLimited(decision.name)
+	header.Set(HeaderRetryAfter, ceilSeconds(decision.retryAfter))
+
+	return s.limiter.status
+}
+
+func ceilSeconds(dur time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(dur.Seconds())))
+}
@@ -0,0 +1,235 @@
+//nolint:testpackage // Tests the unexported rate limiter.
+package webserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+)
+
+// newTestLimiter returns a rate limiter with a fake clock. Advance the clock with the returned pointer.
+func newTestLimiter(t *testing.T, config *RateLimitConfig) (*rateLimiter, *time.Time) {
+	t.Helper()
+
+	limiter, err := newRateLimiter(config, ProxyModeNginx)
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+
+	t.Cleanup(limiter.Stop)
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	return limiter, &now
+}
+
+func TestRateLimiter_bucket(t *testing.T) {
+	t.Parallel()
+
+	limiter, now := newTestLimiter(t, &RateLimitConfig{Limits: []*RateLimit{{Requests: 2, Per: time.Second}}})
+	user := &userinfo.UserInfo{APIKey: "key1", UserID: "1", Environment: "live"}
+
+	for want := 1; want >= 0; want-- {
+		if decision := limiter.check(user, "/"); decision.retryAfter != 0 || decision.remaining != want {
+			t.Fatalf("request allowed: %+v, want remaining %d", decision, want)
+		}
+	}
+
+	decision := limiter.check(user, "/")
+	if decision.retryAfter != 500*time.Millisecond || decision.name != "key" || decision.limit != 2 {
+		t.Fatalf("third request: %+v, want throttled for 500ms", decision)
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+
+	if decision := limiter.check(user, "/"); decision.retryAfter != 0 {
+		t.Fatalf("after refill: %+v, want allowed", decision)
+	}
+
+	other := &userinfo.UserInfo{APIKey: "key2", UserID: "1", Environment: "live"}
+	if decision := limiter.check(other, "/"); decision.retryAfter != 0 {
+		t.Fatalf("other key: %+v, want its own bucket", decision)
+	}
+}
+
+func TestRateLimiter_byUserAndMatching(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := newTestLimiter(t, &RateLimitConfig{Limits: []*RateLimit{
+		{By: RateLimitByUser, Requests: 1, Environment: "live", PathPrefix: "/api/v1"},
+	}})
+	key1 := &userinfo.UserInfo{APIKey: "key1", UserID: "1", Environment: "live"}
+	key2 := &userinfo.UserInfo{APIKey: "key2", UserID: "1", Environment: "live"}
+	dev := &userinfo.UserInfo{APIKey: "key3", UserID: "3", Environment: "dev"}
+
+	if limiter.check(dev, "/api/v1/x") != nil || limiter.check(key1, "/api/v2/x?/api/v1") != nil {
+		t.Fatal("limit must only apply to its environment and path prefix")
+	}
+
+	if decision := limiter.check(key1, "/api/v1/x"); decision.retryAfter != 0 {
+		t.Fatalf("first request: %+v, want allowed", decision)
+	}
+
+	if decision := limiter.check(key2, "/api/v1/y"); decision.retryAfter == 0 || decision.name != "user:live:/api/v1" {
+		t.Fatalf("same user, other key: %+v, want throttled by the user limit", decision)
+	}
+}
+
+func TestRateLimiter_tiersAndQuotas(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := newTestLimiter(t, &RateLimitConfig{Tiers: map[string]*RateLimit{
+		"free": {By: RateLimitByUser, Requests: 1},
+		"pro":  {By: RateLimitByUser, Requests: 100},
+	}})
+
+	if limiter.check(&userinfo.UserInfo{APIKey: "key0", UserID: "0", RateTier: "unknown"}, "/") != nil {
+		t.Fatal("unknown tier must not be rate limited")
+	}
+
+	free := &userinfo.UserInfo{APIKey: "key1", UserID: "1", RateTier: "free"}
+	if decision := limiter.check(free, "/"); decision.retryAfter != 0 || decision.name != "tier:free" {
+		t.Fatalf("free tier first request: %+v, want allowed", decision)
+	}
+
+	if decision := limiter.check(free, "/"); decision.retryAfter == 0 {
+		t.Fatalf("free tier second request: %+v, want throttled", decision)
+	}
+
+	// The quota columns replace the tier.
+	quota := &userinfo.UserInfo{APIKey: "key2", UserID: "2", RateTier: "free", RateLimit: 3, RatePeriod: 3600}
+	for want := 2; want >= 0; want-- {
+		decision := limiter.check(quota, "/")
+		if decision.retryAfter != 0 || decision.name != rateLimitQuota || decision.limit != 3 || decision.remaining != want {
+			t.Fatalf("quota request: %+v, want allowed with %d remaining", decision, want)
+		}
+	}
+
+	if decision := limiter.check(quota, "/"); decision.retryAfter != 20*time.Minute || ceilSeconds(decision.reset) != "3600" {
+		t.Fatalf("quota exhausted: %+v, want throttled for 20m", decision)
+	}
+}
+
+func TestHandleAuth_rateLimitHeaders(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	srv.limiter, _ = newTestLimiter(t, &RateLimitConfig{Limits: []*RateLimit{{Requests: 10, Per: time.Minute}}})
+
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+	for header, want := range map[string]string{
+		HeaderXRateLimitLimit:     "10",
+		HeaderXRateLimitRemaining: "9",
+		HeaderXRateLimitReset:     "6",
+		HeaderRetryAfter:          "",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestHandleAuth_rateLimited(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	srv.limiter, _ = newTestLimiter(t, &RateLimitConfig{Limits: []*RateLimit{{Requests: 1, Per: time.Minute}}})
+
+	for _, want := range []int{http.StatusOK, http.StatusForbidden} {
+		rec := httptest.NewRecorder()
+		srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+		if rec.Code != want {
+			t.Fatalf("status = %d, want %d", rec.Code, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+	if retry := rec.Header().Get(HeaderRetryAfter); retry != "60" {
+		t.Fatalf("Retry-After = %q, want 60", retry)
+	}
+}
+
+func TestNewRateLimiter_invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, limit := range []*RateLimit{{Requests: 0}, {Requests: 1, By: "ip"}} {
+		if _, err := newRateLimiter(&RateLimitConfig{Limits: []*RateLimit{limit}}, ProxyModeNginx); !errors.Is(err, ErrInvalidRateLimit) {
+			t.Errorf("%+v: err = %v, want ErrInvalidRateLimit", limit, err)
+		}
+	}
+}
+
+func TestNewRateLimiter_status(t *testing.T) {
+	t.Parallel()
+
+	limits := []*RateLimit{{Requests: 1}}
+
+	// Only proxies that pass the auth response to the client get 429 by default.
+	for mode, want := range map[string]int{
+		"":               http.StatusForbidden,
+		ProxyModeNginx:   http.StatusForbidden,
+		ProxyModeHAProxy: http.StatusForbidden,
+		ProxyModeTraefik: http.StatusTooManyRequests,
+		ProxyModeCaddy:   http.StatusTooManyRequests,
+	} {
+		limiter, err := newRateLimiter(&RateLimitConfig{Limits: limits}, mode)
+		if err != nil || limiter.status != want {
+			t.Fatalf("mode %q default status: %v, %v, want %d", mode, limiter, err, want)
+		}
+
+		limiter.Stop()
+	}
+
+	if _, err := newRateLimiter(&RateLimitConfig{Status: http.StatusTooManyRequests, Limits: limits}, ProxyModeNginx); !errors.Is(err, ErrInvalidRateLimit) {
+		t.Fatalf("status 429 with nginx: err = %v, want ErrInvalidRateLimit", err)
+	}
+}
+
+func TestRateLimiter_throttledTakesNoTokens(t *testing.T) {
+	t.Parallel()
+
+	limiter, _ := newTestLimiter(t, &RateLimitConfig{Limits: []*RateLimit{
+		{Requests: 5, Per: time.Minute},
+		{Requests: 1, Per: time.Minute, PathPrefix: "/api"},
+	}})
+	user := &userinfo.UserInfo{APIKey: "key1", UserID: "1", Environment: "live"}
+
+	for _, throttled := range []bool{false, true, true} {
+		if decision := limiter.check(user, "/api/x"); (decision.retryAfter > 0) != throttled || decision.name != "key::/api" {
+			t.Fatalf("request to /api: %+v, want throttled %v by the /api limit", decision, throttled)
+		}
+	}
+
+	// Only the allowed request took a token from the first limit.
+	if decision := limiter.check(user, "/"); decision.retryAfter != 0 || decision.remaining != 3 {
+		t.Fatalf("request to /: %+v, want 3 remaining", decision)
+	}
+}
+
+func TestHandleAuth_rateLimitSkipsFailures(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, nil)
+	srv.limiter, _ = newTestLimiter(t, &RateLimitConfig{Limits: []*RateLimit{{Requests: 1, Per: time.Minute}}})
+	backend.setErr(errFakeDB)
+
+	// Database errors and unknown keys are answered with the default user, which is not rate limited.
+	for _, key := range []string{TestAccessLogAPIKey, TestAccessLogAPIKey, "unknown-key-000000000000000000000000"} {
+		rec := httptest.NewRecorder()
+		srv.handleAuth(rec, authRequest(map[string]string{HeaderXAPIKey: key}))
+
+		if rec.Code == http.StatusTooManyRequests || rec.Header().Get(HeaderXRateLimitLimit) != "" {
+			t.Fatalf("%s: status = %d with rate limit headers %v", key, rec.Code, rec.Header())
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+/* This file contains the graceful shutdown: drain requests, close the backend, flush the logs. */
+
+// serve runs the web server on listener until ctx is cancelled, then drains in-flight
+// requests for up to ShutdownTimeout. Requests still running after the deadline have their
+// connections closed; shutdown waits for their handlers to return.
+func (s *server) serve(ctx context.Context, listener net.Listener) error {
+	errCh := make(chan error, 1)
+
+	go func() { errCh <- s.server.Serve(listener) }()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("cannot start web server: %w", err)
+		}
+
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.stopping.Store(true)
+	s.Printf("Shutting down! Draining in-flight requests for up to %v", s.shutdownTimeout())
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+
+	if err := s.server.Shutdown(drainCtx); err != nil {
+		s.Printf("[ERROR] Draining web server: %v, closing remaining connections", err)
+		_ = s.server.Close()
+	}
+
+	return nil
+}
+
+func (s *server) shutdownTimeout() time.Duration {
+	if s.ShutdownTimeout > 0 {
+		return s.ShutdownTimeout
+	}
+
+	return defaultShutdownTimeout
+}
+
+// shutdown waits for abandoned requests and background refreshes, saves the cache snapshot, closes the
+// backend and logs a summary. It runs before the caches are stopped, so their stats are still available,
+// no request uses a stopped cache, and the snapshot has every cache update.
+func (s *server) shutdown() {
+	s.inflight.Wait()
+	s.background.Wait()
+
+	if err := s.saveSnapshot(); err != nil {
+		s.Printf("[ERROR] %v", err)
+	}
+
+	if err := s.ui.Close(); err != nil {
+		s.Printf("[ERROR] %v", err)
+	}
+
+	s.Printf("Shutdown complete. Uptime: %v, requests served: %d, cached users: %d, cached servers: %d",
+		time.Since(s.started).Round(time.Second), s.requests.Load(), s.users.Stats().Size, s.servers.Stats().Size)
+}
+
+// closeLogs flushes and closes the rotated access and error log files, and the buffered log targets.
+func (s *server) closeLogs() {
+	if s.logRot != nil {
+		if err := s.logRot.Close(); err != nil {
+			s.Printf("[ERROR] Closing access log: %v", err)
+		}
+	}
+
+	if s.logOut != nil {
+		if err := s.logOut.Close(); err != nil {
+			s.Printf("[ERROR] Closing access log: %v", err)
+		}
+	}
+
+	if s.errRot != nil {
+		_ = s.errRot.Close() // nowhere left to report this.
+	}
+
+	if s.errOut != nil {
+		log.SetOutput(os.Stderr) // so a fatal error after shutdown is still seen.
+		_ = s.errOut.Close()     // nowhere left to report this.
+	}
+}
@@ -0,0 +1,122 @@
+//nolint:testpackage // Tests unexported shutdown with a fake backend.
+package webserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTestServe runs serve on a random port. Returns the base url,
+// a function that starts the shutdown, and serve's result channel.
+func startTestServe(t *testing.T, srv *server) (string, context.CancelFunc, chan error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv.httpLog = log.New(io.Discard, "", 0)
+	srv.server = srv.newHTTPServer()
+
+	listener, err := (&net.ListenConfig{}).Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- srv.serve(ctx, listener) }()
+
+	return "http://" + listener.Addr().String(), cancel, done
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, nil)
+	backend.delay = 200 * time.Millisecond
+	url, cancel, done := startTestServe(t, srv)
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, url+"/auth", nil)
+		req.Header.Set(HeaderXAPIKey, TestAccessLogAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		results <- result{resp, err}
+	}()
+
+	for backend.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel() // shut down while the lookup is in flight.
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("in-flight request failed during shutdown: %v", res.err)
+	}
+
+	res.resp.Body.Close()
+
+	if res.resp.StatusCode != http.StatusOK || res.resp.Header.Get(HeaderXUsername) != "alice" {
+		t.Fatalf("in-flight request: status %d, username %q", res.resp.StatusCode, res.resp.Header.Get(HeaderXUsername))
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("serve returned error: %v", err)
+	}
+
+	if srv.requests.Load() != 1 {
+		t.Fatalf("requests counted = %d, want 1", srv.requests.Load())
+	}
+}
+
+func TestServeShutdownDeadline(t *testing.T) {
+	t.Parallel()
+
+	srv, backend := newTestServer(t, &Config{ShutdownTimeout: 50 * time.Millisecond})
+	backend.delay = 500 * time.Millisecond
+	url, cancel, done := startTestServe(t, srv)
+
+	go func() {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, url+"/auth", nil)
+		req.Header.Set(HeaderXAPIKey, TestAccessLogAPIKey)
+
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	for backend.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("serve returned error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= backend.delay {
+		t.Fatalf("shutdown took %v, want it to stop at the deadline", elapsed)
+	}
+
+	// The abandoned lookup finishes before shutdown closes the backend, and before the caches are stopped.
+	srv.shutdown()
+
+	if srv.requests.Load() != 1 {
+		t.Fatalf("shutdown returned before the abandoned request finished")
+	}
+}
@@ -0,0 +1,163 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"golift.io/cache"
+)
+
+/* This file contains the cache snapshot: the caches are saved to disk and loaded on startup. */
+
+// snapshot is the on-disk format of the users and servers caches.
+type snapshot struct {
+	Saved   time.Time               `json:"saved"`
+	Users   map[string]snapshotItem `json:"users"`
+	Servers map[string]snapshotItem `json:"servers"`
+}
+
+// snapshotItem is one cached user or server and when it was saved to the cache.
+type snapshotItem struct {
+	User *userinfo.UserInfo `json:"user"`
+	Time time.Time          `json:"time"`
+}
+
+const snapshotFileMode = 0o600 // contains api keys.
+
+// snapshotItems converts a cache list into snapshot items.
+func snapshotItems(list map[string]*cache.Item) map[string]snapshotItem {
+	items := make(map[string]snapshotItem, len(list))
+
+	for key, item := range list {
+		if user, ok := item.Data.(*userinfo.UserInfo); ok && user != nil {
+			items[key] = snapshotItem{User: user, Time: cachedAt(user, item.Time)}
+		}
+	}
+
+	return items
+}
+
+// saveSnapshot writes the users and servers caches to CacheFile.
+// The file is written to a temporary file first, and renamed into place.
+func (s *server) saveSnapshot() error {
+	if s.CacheFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(&snapshot{
+		Saved:   time.Now(),
+		Users:   snapshotItems(s.users.List()),
+		Servers: snapshotItems(s.servers.List()),
+	})
+	if err != nil {
+		return fmt.Errorf("encoding cache snapshot: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.CacheFile), filepath.Base(s.CacheFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating cache snapshot: %w", err)
+	}
+	defer os.Remove(tmpFile.Name()) //nolint:errcheck // it's renamed on success.
+
+	if _, err = tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return fmt.Errorf("writing cache snapshot: %w", err)
+	}
+
+	if err = tmpFile.Chmod(snapshotFileMode); err != nil {
+		_ = tmpFile.Close()
+		return fmt.Errorf("writing cache snapshot: %w", err)
+	}
+
+	if err = tmpFile.Close(); err != nil {
+		return fmt.Errorf("writing cache snapshot: %w", err)
+	}
+
+	if err = os.Rename(tmpFile.Name(), s.CacheFile); err != nil {
+		return fmt.Errorf("renaming cache snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// loadSnapshot fills the users and servers caches from CacheFile.
+// Items older than CacheFileMaxAge are dropped. A missing file is not an error.
+func (s *server) loadSnapshot() error {
+	if s.CacheFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.CacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading cache snapshot: %w", err)
+	}
+
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decoding cache snapshot: %w", err)
+	}
+
+	users, dropped := s.restoreItems("users", s.users, snap.Users)
+	servers, droppedServers := s.restoreItems("servers", s.servers, snap.Servers)
+	s.Printf("Loaded %d users and %d servers from cache file %s saved %v ago, dropped %d old items",
+		users, servers, s.CacheFile, time.Since(snap.Saved).Round(time.Second), dropped+droppedServers)
+
+	return nil
+}
+
+// restoreItems saves snapshot items into a cache. Returns the count of restored and dropped items.
+func (s *server) restoreItems(label string, store *cache.Cache, items map[string]snapshotItem) (int, int) {
+	var restored, dropped int
+
+	now := time.Now()
+
+	for key, item := range items {
+		if item.User == nil || (s.CacheFileMaxAge > 0 && now.Sub(item.Time) > s.CacheFileMaxAge) ||
+			s.cacheExpired(item.User, item.Time, now) {
+			dropped++
+			continue
+		}
+
+		restored++
+		item.User.Cached = item.Time // the cache records the time of this save.
+
+		if item.User.UserID == userinfo.DefaultUserID {
+			store.Save(key, item.User, cache.Options{Prune: true})
+			continue
+		}
+
+		store.Save(key, item.User, s.validUserOptions(item.Time))
+		s.saveStale(label, key, item.User, item.Time)
+	}
+
+	return restored, dropped
+}
+
+// snapshotLoop saves the cache snapshot every CacheSaveInterval until ctx is cancelled.
+func (s *server) snapshotLoop(ctx context.Context) {
+	if s.CacheFile == "" || s.CacheSaveInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.CacheSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.saveSnapshot(); err != nil {
+				s.Printf("[ERROR] %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+//nolint:testpackage // Tests unexported cache snapshot methods.
+package webserver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"golift.io/cache"
+)
+
+func TestSnapshot_saveAndLoad(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "cache.json")
+	srv, _ := newTestServer(t, &Config{CacheFile: file})
+	srv.users.Save(TestAccessLogAPIKey, &userinfo.UserInfo{UserID: "1001", Username: "alice"}, cache.Options{})
+	srv.users.Save("missing", userinfo.DefaultUser(), cache.Options{Prune: true})
+	srv.servers.Save("1234", &userinfo.UserInfo{UserID: "1001", Username: "alice"}, cache.Options{})
+
+	if err := srv.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != snapshotFileMode {
+		t.Fatalf("snapshot file: %v, %v", info, err)
+	}
+
+	loaded, _ := newTestServer(t, &Config{CacheFile: file})
+	if err := loaded.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if user, _, ok := cacheUserFromGetInto(loaded.users, TestAccessLogAPIKey); !ok || user.Username != "alice" {
+		t.Fatalf("user not restored: %v", user)
+	}
+
+	if loaded.users.Get("missing") == nil || loaded.servers.Get("1234") == nil {
+		t.Fatal("expected missing user and server to be restored")
+	}
+}
+
+func TestSnapshot_loadDropsOldItems(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "cache.json")
+	data, _ := json.Marshal(&snapshot{
+		Saved: time.Now(),
+		Users: map[string]snapshotItem{
+			"old": {User: &userinfo.UserInfo{UserID: "1"}, Time: time.Now().Add(-2 * time.Hour)},
+			"new": {User: &userinfo.UserInfo{UserID: "2"}, Time: time.Now().Add(-time.Minute)},
+		},
+	})
+
+	if err := os.WriteFile(file, data, snapshotFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _ := newTestServer(t, &Config{CacheFile: file, CacheFileMaxAge: time.Hour})
+	if err := srv.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.users.Get("old") != nil || srv.users.Get("new") == nil {
+		t.Fatal("expected only the new item to be loaded")
+	}
+}
+
+func TestSnapshot_keepsCacheTime(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "cache.json")
+	cached := time.Now().Add(-30 * time.Minute).Round(time.Second)
+	data, _ := json.Marshal(&snapshot{
+		Saved: time.Now(),
+		Users: map[string]snapshotItem{TestAccessLogAPIKey: {User: &userinfo.UserInfo{UserID: "1001"}, Time: cached}},
+	})
+
+	if err := os.WriteFile(file, data, snapshotFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _ := newTestServer(t, &Config{CacheFile: file, CacheMaxAge: time.Hour})
+	if err := srv.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The age is counted from the original cache time, not the restore, so restarts do not extend it.
+	if _, when, ok := cacheUserFromGetInto(srv.users, TestAccessLogAPIKey); !ok || !when.Equal(cached) {
+		t.Fatalf("restored user cached at %v, want %v", when, cached)
+	}
+
+	if err := srv.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ = os.ReadFile(file)
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil || !snap.Users[TestAccessLogAPIKey].Time.Equal(cached) {
+		t.Fatalf("saved again with time %v, want %v: %v", snap.Users[TestAccessLogAPIKey].Time, cached, err)
+	}
+}
+
+func TestSnapshot_missingFile(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{CacheFile: filepath.Join(t.TempDir(), "nope.json")})
+	if err := srv.loadSnapshot(); err != nil {
+		t.Fatalf("missing file should not be an error: %v", err)
+	}
+}
+
+func TestShutdown_savesSnapshotAfterBackground(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "cache.json")
+	srv, _ := newTestServer(t, &Config{CacheFile: file})
+
+	// A background refresh that finishes during shutdown must be in the snapshot.
+	srv.background.Go(func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.users.Save(TestAccessLogAPIKey, &userinfo.UserInfo{UserID: "1001", Username: "alice"}, cache.Options{})
+	})
+
+	srv.shutdown()
+
+	loaded, _ := newTestServer(t, &Config{CacheFile: file})
+	if err := loaded.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.users.Get(TestAccessLogAPIKey) == nil {
+		t.Fatal("the background refresh is missing from the snapshot")
+	}
+}
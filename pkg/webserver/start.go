@@ -2,19 +2,25 @@ package webserver
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Notifiarr/mysql-auth-proxy/docs"
 	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
 	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 	"golift.io/cache"
 	"golift.io/cnfg"
 	"golift.io/cnfgfile"
@@ -23,22 +29,26 @@ import (
 )
 
 const (
-	pruneInterval = 3 * time.Minute
-	timeout       = 15 * time.Second
+	pruneInterval          = 3 * time.Minute
+	timeout                = 15 * time.Second
+	defaultShutdownTimeout = 8 * time.Second // docker stop waits 10 seconds.
 )
 
 // Canonical HTTP Headers.
 const (
-	HeaderXAPIKey       = "X-Api-Key"  //nolint:gosec // not a cred.
-	HeaderXAPIKeys      = "X-Api-Keys" //nolint:gosec // not a cred.
-	HeaderXOriginalURI  = "X-Original-Uri"
-	HeaderXServer       = "X-Server"
-	HeaderXUsername     = "X-Username"
-	HeaderXUserid       = "X-Userid"
-	HeaderXForwardedFor = "X-Forwarded-For"
-	HeaderEnvironment   = "X-Environment"
-	HeaderContentType   = "Content-Type"
-	HeaderAge           = "Age"
+	HeaderXAPIKey        = "X-Api-Key"  //nolint:gosec // not a cred.
+	HeaderXAPIKeys       = "X-Api-Keys" //nolint:gosec // not a cred.
+	HeaderXOriginalURI   = "X-Original-Uri"
+	HeaderXServer        = "X-Server"
+	HeaderXUsername      = "X-Username"
+	HeaderXUserid        = "X-Userid"
+	HeaderXForwardedFor  = "X-Forwarded-For"
+	HeaderXForwardedURI  = "X-Forwarded-Uri"
+	HeaderXForwardedHost = "X-Forwarded-Host"
+	HeaderEnvironment    = "X-Environment"
+	HeaderContentType    = "Content-Type"
+	HeaderAge            = "Age"
+	HeaderXAuthStale     = "X-Auth-Stale"
 )
 
 // Config is the input data for the server.
@@ -50,9 +60,50 @@ type Config struct {
 	LogFile     string   `json:"logFile"     toml:"log_file"      xml:"log_file"`
 	ErrorFile   string   `json:"errorFile"   toml:"error_file"    xml:"error_file"`
 	NoAuthPaths []string `json:"noAuthPaths" toml:"no_auth_paths" xml:"no_auth_path"`
+	// LogFormat is the access log format: apache, json or logfmt. Default: apache.
+	LogFormat string `json:"logFormat,omitempty" toml:"log_format" xml:"log_format"`
+	// LogTarget is where the access log goes: file, stdout, json, syslog, udp://host:port or tcp://host:port.
+	// Default: file when log_file is set, otherwise stdout.
+	LogTarget string `json:"logTarget,omitempty" toml:"log_target" xml:"log_target"`
+	// ErrorTarget is where the error log goes. Same values as LogTarget, with error_file and stderr.
+	ErrorTarget string `json:"errorTarget,omitempty" toml:"error_target" xml:"error_target"`
+	// SyslogTag is the syslog app name. Default: authproxy.
+	SyslogTag string `json:"syslogTag,omitempty" toml:"syslog_tag" xml:"syslog_tag"`
+	// LogBuffer is how many lines the json and syslog targets buffer before dropping lines. Default: 1024.
+	LogBuffer int `json:"logBuffer,omitempty" toml:"log_buffer" xml:"log_buffer"`
 	// CacheShards is golift.io/cache partition count for users and servers; 0 means library default (single shard).
-	CacheShards int    `json:"cacheShards,omitempty" toml:"cache_shards" xml:"cache_shards"`
-	filePath    string // path to loaded config file.
+	CacheShards int `json:"cacheShards,omitempty" toml:"cache_shards" xml:"cache_shards"`
+	// CacheMaxAge expires valid users and servers from the cache after this long. 0 keeps them until deleted.
+	CacheMaxAge time.Duration `json:"cacheMaxAge,omitempty" toml:"cache_max_age" xml:"cache_max_age"`
+	// CacheRefresh re-queries cached valid users in the background once they are this old. 0 disables.
+	CacheRefresh time.Duration `json:"cacheRefresh,omitempty" toml:"cache_refresh" xml:"cache_refresh"`
+	// StaleMaxAge keeps valid users this long in a stale store that is served when the database fails. 0 disables.
+	StaleMaxAge time.Duration `json:"staleMaxAge,omitempty" toml:"stale_max_age" xml:"stale_max_age"`
+	// CacheFile is where the users and servers caches are saved on shutdown, and loaded from on startup.
+	CacheFile string `json:"cacheFile,omitempty" toml:"cache_file" xml:"cache_file"`
+	// CacheSaveInterval also saves the CacheFile periodically. 0 only saves on shutdown.
+	CacheSaveInterval time.Duration `json:"cacheSaveInterval,omitempty" toml:"cache_save_interval" xml:"cache_save_interval"`
+	// CacheFileMaxAge drops items older than this when loading the CacheFile. 0 keeps every item.
+	CacheFileMaxAge time.Duration `json:"cacheFileMaxAge,omitempty" toml:"cache_file_max_age" xml:"cache_file_max_age"`
+	// ProxyMode is the reverse proxy in front of /auth: nginx, traefik, caddy or haproxy. Default: nginx.
+	ProxyMode string `json:"proxyMode,omitempty" toml:"proxy_mode" xml:"proxy_mode"`
+	// KeyRules are tried in order to find the API key in a request. Default: X-Api-Key, then uri path segment 5.
+	KeyRules []*KeyRule `json:"keyRules,omitempty" toml:"key_rules" xml:"key_rule"`
+	// RateLimit throttles user auth requests per API key or user ID.
+	RateLimit *RateLimitConfig `json:"rateLimit,omitempty" toml:"rate_limit" xml:"rate_limit"`
+	// Top tracks the most active user IDs and API keys for /stats/top and the authproxy_top_requests metric.
+	Top *TopConfig `json:"top,omitempty" toml:"top" xml:"top"`
+	// Tracing exports OpenTelemetry spans for auth requests and backend queries.
+	Tracing *TracingConfig `json:"tracing,omitempty" toml:"tracing" xml:"tracing"`
+	// GRPCListenAddr is where the Envoy ext_authz gRPC server listens. Empty disables it.
+	GRPCListenAddr string `json:"grpcListenAddr,omitempty" toml:"grpc_listen_addr" xml:"grpc_listen_addr"`
+	// ReadyTimeout is how long /readyz waits for a database ping. Default: 2s.
+	ReadyTimeout time.Duration `json:"readyTimeout,omitempty" toml:"ready_timeout" xml:"ready_timeout"`
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown. Default: 8s.
+	ShutdownTimeout time.Duration `json:"shutdownTimeout,omitempty" toml:"shutdown_timeout" xml:"shutdown_timeout"`
+	// Admin protects the stats, reload, metrics and docs endpoints.
+	Admin    *AdminConfig `json:"admin,omitempty" toml:"admin" xml:"admin"`
+	filePath string       // path to loaded config file.
 }
 
 // server holds the running data.
@@ -61,13 +112,40 @@ type server struct {
 
 	users   *cache.Cache
 	servers *cache.Cache
-	ui      *userinfo.UI
+	stale   *cache.Cache // copies of valid users and servers, served when the backend fails.
+	ui      userinfo.Backend
 	httpLog *log.Logger
 	server  *http.Server
+	logRot  *rotatorr.Logger
 	errRot  *rotatorr.Logger
+	logOut  *asyncWriter // json or syslog access log target.
+	errOut  *asyncWriter // json or syslog error log target.
+	started time.Time
+	// tracer is nil when tracing is disabled. traceProvider flushes spans on shutdown.
+	tracer        trace.Tracer
+	traceProvider *sdktrace.TracerProvider
+	// requests counts the http requests served, for the shutdown summary.
+	requests atomic.Uint64
+	// readyz caches the database ping reported by /readyz.
+	readyz readyCache
+	// stopping is set when shutdown begins, so /readyz reports not ready while requests drain.
+	stopping atomic.Bool
+	admin    *adminAuth
+	keyRules []*keyRule   // nil uses defaultKeyRules.
+	limiter  *rateLimiter // nil when rate limiting is disabled.
+	top      *topTracker  // nil when top tracking is disabled.
 	// noAuthMu protects NoAuthPaths on the embedded Config (RequiresAPIKey, reload, showConfig).
 	noAuthMu sync.RWMutex
 	metrics  *exp.Metrics
+	// refreshing tracks keys with a background refresh in progress.
+	refreshing sync.Map
+	// flights collapses concurrent backend lookups for the same key.
+	flights singleflight.Group
+	// background tracks background cache refreshes, so shutdown can wait for them.
+	background sync.WaitGroup
+	// inflight tracks http requests and gRPC checks, so shutdown can wait for the ones
+	// abandoned at the drain deadline before the backend is closed and the caches are stopped.
+	inflight sync.WaitGroup
 }
 
 // ErrNoSQLConfig is returned if no mysql config is present.
@@ -97,6 +175,18 @@ func LoadConfig(filename string) (*Config, error) { //nolint:cyclop
 		config.ListenAddr = "0.0.0.0:8080"
 	}
 
+	if err := config.checkProxyMode(); err != nil {
+		return nil, err
+	}
+
+	if err := config.checkLogFormat(); err != nil {
+		return nil, err
+	}
+
+	if err := config.checkLogTargets(); err != nil {
+		return nil, err
+	}
+
 	if fileName := os.Getenv("AP_MYSQL_PASS_FILE"); config.Pass == "" && fileName != "" {
 		fileData, err := os.ReadFile(fileName)
 		if err != nil {
@@ -118,21 +208,85 @@ func LoadConfig(filename string) (*Config, error) { //nolint:cyclop
 	return &config, nil
 }
 
-// Start runs the app.
-func Start(config *Config) error {
-	server := &server{Config: config}
-	server.setupLogs()
+// Start runs the app until ctx is cancelled, then shuts it down gracefully.
+func Start(ctx context.Context, config *Config) error {
+	server := &server{Config: config, started: time.Now()}
+	defer server.closeLogs()
+
+	if err := server.setupLogs(); err != nil {
+		return fmt.Errorf("setting up logs: %w", err)
+	}
+
 	server.Println("Auth proxy starting up!")
-	server.Printf("DB Host %s, Log: %s, Errors: %s, User: %s, DB Name: %s, Password: %v",
-		config.Host, config.LogFile, config.ErrorFile, config.User, config.Name, config.Password != "")
+	server.Printf("DB Driver: %s, Host %s, Log: %s (%s), Errors: %s, User: %s, DB Name: %s, Password: %v",
+		server.driverName(), config.Host, config.LogFile, config.LogFormat, config.ErrorFile, config.User, config.Name, config.Password != "")
+	for _, host := range config.Hosts {
+		server.Printf("DB Host: %s, Role: %s", host.Host, host.Role)
+	}
+
+	server.Printf("Proxy mode: %s", config.ProxyMode)
 	server.Printf("No-Key-Required Paths (%d): %s",
 		len(config.NoAuthPaths), strings.Join(config.NoAuthPaths, ", "))
-	server.Printf("Cache shards: %d", config.CacheShards)
+	server.Printf("Cache shards: %d, max age: %v, refresh after: %v, stale max age: %v",
+		config.CacheShards, config.CacheMaxAge, config.CacheRefresh, config.StaleMaxAge)
+
+	if config.CacheFile != "" {
+		server.Printf("Cache file: %s, save interval: %v, max item age: %v",
+			config.CacheFile, config.CacheSaveInterval, config.CacheFileMaxAge)
+	}
+
+	admin, err := newAdminAuth(config.Admin)
+	if err != nil {
+		return fmt.Errorf("admin config: %w", err)
+	}
+
+	server.admin = admin
+
+	if server.keyRules, err = newKeyRules(config.KeyRules); err != nil {
+		return fmt.Errorf("key rules: %w", err)
+	}
+
+	for _, rule := range server.rules() {
+		server.Printf("API key rule: %s, length: %d, format: %q", rule.Name, rule.Length, rule.Format)
+	}
+
+	if server.limiter, err = newRateLimiter(config.RateLimit, config.ProxyMode); err != nil {
+		return fmt.Errorf("rate limit: %w", err)
+	}
+	defer server.limiter.Stop()
 
-	return server.start()
+	if server.limiter != nil {
+		for _, limit := range server.limiter.all() {
+			server.Printf("Rate limit %s: %d requests per %v, burst %d, by %s",
+				limit.Name, limit.Requests, limit.Per, limit.Burst, limit.By)
+		}
+	}
+
+	if server.top = newTopTracker(config.Top); server.top != nil {
+		server.Printf("Tracking top %d users and keys over windows: %v", server.top.size, server.top.windows)
+	}
+
+	if err := server.setupTracing(ctx); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	defer server.stopTracing()
+
+	if server.tracer != nil {
+		server.Printf("Tracing to %s (%s), sample ratio: %v",
+			config.Tracing.Endpoint, config.Tracing.Protocol, config.Tracing.SampleRatio)
+	}
+
+	if admin.open() {
+		server.Println("[WARNING] Admin endpoints are not protected! Configure an admin token, users or allow_nets.")
+	} else {
+		server.Printf("Admin auth: token: %v, users: %d, allowed networks: %d",
+			len(admin.token) > 0, len(admin.users), len(admin.nets))
+	}
+
+	return server.start(ctx)
 }
 
-func (s *server) start() error {
+func (s *server) start(ctx context.Context) error {
 	s.users = cache.New(cache.Config{
 		PruneInterval:   pruneInterval,
 		RequestAccuracy: time.Second,
@@ -141,43 +295,123 @@ func (s *server) start() error {
 	defer s.users.Stop(false)
 
 	s.servers = cache.New(cache.Config{
+		PruneInterval:   s.serverPruneInterval(),
 		RequestAccuracy: time.Second,
 		Shards:          s.CacheShards,
 	})
 	defer s.servers.Stop(false)
 
-	s.metrics = exp.GetMetrics(&exp.CacheCollector{Stats: exp.CacheList{
+	stats := exp.CacheList{
 		"servers": s.servers.Stats,
 		"users":   s.users.Stats,
-	}})
+	}
+
+	if s.StaleMaxAge > 0 {
+		s.stale = cache.New(cache.Config{
+			PruneInterval:   pruneInterval,
+			MaxUnused:       cache.Forever, // stale items are rarely read, they expire with StaleMaxAge.
+			RequestAccuracy: time.Second,
+			Shards:          s.CacheShards,
+		})
+		defer s.stale.Stop(false)
+
+		stats["stale"] = s.stale.Stats
+	}
+
+	s.metrics = exp.GetMetrics(&exp.CacheCollector{Stats: stats, Top: s.top.metrics})
+
+	for _, rule := range s.rules() {
+		s.metrics.KeyRules.WithLabelValues(rule.Name)
+	}
+
+	s.metrics.KeyRules.WithLabelValues(keyRuleNone)
+
+	if s.limiter != nil {
+		for _, limit := range s.limiter.all() {
+			s.metrics.RateLimited.WithLabelValues(limit.Name)
+		}
+
+		s.metrics.RateLimited.WithLabelValues(rateLimitQuota)
+	}
+
+	s.metrics.LogDropped.WithLabelValues(logAccess)
+	s.metrics.LogDropped.WithLabelValues(logError)
 
 	info, err := userinfo.New(s.Config.Config, s.metrics)
 	if err != nil {
 		return fmt.Errorf("initializing userinfo: %w", err)
 	}
 
-	s.Println("Initialized MySQL successfully")
-	s.Printf("HTTP listening at: %s", s.ListenAddr)
+	s.Printf("Initialized %s backend successfully", s.driverName())
 
 	s.ui = info
+	defer s.shutdown() // saves the snapshot and closes the backend, before the caches are stopped.
+
+	if err := s.loadSnapshot(); err != nil {
+		s.Printf("[ERROR] %v", err) // not fatal, the caches fill up from the database.
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go s.snapshotLoop(ctx)
+
+	waitGRPC, err := s.startGRPCServer(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() { // stop the gRPC server with the web server, before the backend is closed.
+		cancel()
+		waitGRPC()
+	}()
+
+	return s.startWebServer(ctx)
+}
+
+// serverPruneInterval returns the prune interval for the servers cache.
+// Servers are only pruned when they have a max age, so their Expire time is honored.
+func (s *server) serverPruneInterval() time.Duration {
+	if s.CacheMaxAge > 0 {
+		return pruneInterval
+	}
+
+	return 0
+}
+
+// startWebServer listens on ListenAddr and serves until ctx is cancelled.
+func (s *server) startWebServer(ctx context.Context) error {
+	s.server = s.newHTTPServer()
+
+	listener, err := net.Listen("tcp", s.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("cannot start web server: %w", err)
+	}
+
+	s.Printf("HTTP listening at: %s", listener.Addr())
 
-	return s.startWebServer()
+	return s.serve(ctx, listener)
 }
 
-func (s *server) startWebServer() error {
+func (s *server) newHTTPServer() *http.Server {
 	mux := http.NewServeMux()
-	docsHandler := http.StripPrefix("/docs/", http.FileServer(docs.AssetFS()))
+	docsHandler := s.adminWrap(http.StripPrefix("/docs/", http.FileServer(docs.AssetFS())))
 	mux.Handle("GET /docs/", docsHandler)
 	mux.Handle("HEAD /docs/", docsHandler)
-	mux.HandleFunc("GET /swagger.json", s.handlerSwaggerDoc)
-	mux.HandleFunc("GET /reload", s.reloadConfig)
-	mux.HandleFunc("GET /stats/config", s.showConfig)
-	mux.HandleFunc("GET /stats/keys", s.handeUserList)
-	mux.HandleFunc("GET /stats/servers", s.handeSrvList)
-	mux.HandleFunc("GET /stats/key/{key}", s.handleUserInfo)
-	mux.HandleFunc("GET /stats/server/{key}", s.handleSrvInfo)
-	mux.HandleFunc("/auth", s.handleAuth)
-	mux.Handle("GET /metrics", promhttp.Handler())
+	s.adminHandleFunc(mux, "GET /swagger.json", s.handlerSwaggerDoc)
+	s.adminHandleFunc(mux, "GET /reload", s.reloadConfig)
+	s.adminHandleFunc(mux, "GET /stats/config", s.showConfig)
+	s.adminHandleFunc(mux, "GET /stats/keys", s.handeUserList)
+	s.adminHandleFunc(mux, "GET /stats/servers", s.handeSrvList)
+	s.adminHandleFunc(mux, "GET /stats/key/{key}", s.handleUserInfo)
+	s.adminHandleFunc(mux, "GET /stats/server/{key}", s.handleSrvInfo)
+	s.adminHandleFunc(mux, "GET /stats/top", s.handleTop)
+	s.adminHandleFunc(mux, "DELETE /cache", s.handleDelMatching)
+	mux.HandleFunc("/auth", s.traceAuth(s.handleAuth))
+	mux.HandleFunc("/auth/traefik", s.traceAuth(s.handleForwardAuth))
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.Handle("GET /metrics", s.adminWrap(promhttp.Handler()))
 
 	for _, method := range []string{
 		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
@@ -187,25 +421,18 @@ func (s *server) startWebServer() error {
 		mux.HandleFunc(method+" /{$}", s.noKeyReply)
 	}
 
-	s.server = &http.Server{
+	return &http.Server{
 		Addr:              s.ListenAddr,
-		Handler:           s.accessLogWrap(mux, s.httpLog.Writer()),
+		Handler:           s.accessLogWrap(mux, s.httpLog.Writer(), s.LogFormat),
 		ReadTimeout:       timeout,
 		ReadHeaderTimeout: timeout,
 		WriteTimeout:      timeout,
 		IdleTimeout:       timeout,
 		ErrorLog:          s.Logger,
 	}
-
-	err := s.server.ListenAndServe()
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("cannot start web server: %w", err)
-	}
-
-	return nil
 }
 
-func (s *server) setupLogs() {
+func (s *server) setupLogs() error {
 	const (
 		logFileSize = 20 * 1024 * 1024 // 20 meg
 		keepLogs    = 50
@@ -213,39 +440,62 @@ func (s *server) setupLogs() {
 		fileMode    = 0o644
 	)
 
-	if s.LogFile != "" {
-		s.httpLog = log.New(rotatorr.NewMust(&rotatorr.Config{
+	// Config may not come from LoadConfig.
+	err := s.checkLogTargets()
+	if err != nil {
+		return err
+	}
+
+	switch s.LogTarget {
+	case LogTargetFile:
+		s.logRot = rotatorr.NewMust(&rotatorr.Config{
 			Filepath: s.LogFile, // log file name.
 			FileSize: logFileSize,
 			FileMode: fileMode, // set file mode.
 			Rotatorr: &timerotator.Layout{
 				FileCount: keepLogs, // number of files to keep.
 			},
-		}), "", 0)
-	} else {
+		})
+		s.httpLog = log.New(s.logRot, "", 0)
+	case LogTargetStdout:
 		s.httpLog = log.New(os.Stdout, "", log.LstdFlags)
+	default:
+		if s.logOut, err = s.newLogTarget(s.LogTarget, logAccess); err != nil {
+			return fmt.Errorf("access log: %w", err)
+		}
+
+		s.httpLog = log.New(s.logOut, "", 0)
 	}
 
 	if s.Logger != nil {
-		return
+		return nil
 	}
 
-	if s.ErrorFile == "" {
+	switch s.ErrorTarget {
+	case LogTargetFile:
+		s.errRot = rotatorr.NewMust(&rotatorr.Config{
+			Filepath: s.ErrorFile, // log file name.
+			FileSize: logFileSize / divisor,
+			FileMode: fileMode, // set file mode.
+			Rotatorr: &timerotator.Layout{
+				FileCount:  keepLogs / divisor, // number of files to keep.
+				PostRotate: s.rotateErrLog,
+			},
+		})
+		s.Logger = log.New(s.errRot, "", log.LstdFlags)
+		s.rotateErrLog("", "")
+	case LogTargetStdout:
 		s.Logger = log.New(os.Stderr, "", log.LstdFlags)
-		return
+	default:
+		if s.errOut, err = s.newLogTarget(s.ErrorTarget, logError); err != nil {
+			return fmt.Errorf("error log: %w", err)
+		}
+
+		s.Logger = log.New(s.errOut, "", 0) // the targets add their own timestamps.
+		log.SetOutput(s.errOut)
 	}
 
-	s.errRot = rotatorr.NewMust(&rotatorr.Config{
-		Filepath: s.ErrorFile, // log file name.
-		FileSize: logFileSize / divisor,
-		FileMode: fileMode, // set file mode.
-		Rotatorr: &timerotator.Layout{
-			FileCount:  keepLogs / divisor, // number of files to keep.
-			PostRotate: s.rotateErrLog,
-		},
-	})
-	s.Logger = log.New(s.errRot, "", log.LstdFlags)
-	s.rotateErrLog("", "")
+	return nil
 }
 
 func (s *server) rotateErrLog(_, _ string) {
@@ -253,6 +503,15 @@ func (s *server) rotateErrLog(_, _ string) {
 	log.SetOutput(s.errRot)
 }
 
+// driverName returns the configured user info driver name for logs.
+func (s *server) driverName() string {
+	if s.Driver == "" {
+		return userinfo.DriverMySQL
+	}
+
+	return s.Driver
+}
+
 // RequiresAPIKey returns true if the requested path requires an api key.
 func (s *server) RequiresAPIKey(uriPath string) bool {
 	s.noAuthMu.RLock()
@@ -0,0 +1,219 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"golift.io/cache"
+)
+
+/* This file contains the paging, filtering, sorting and masking of the cached user and server lists. */
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// List sort orders. Access and created sort newest first.
+const (
+	ListSortKey     = "key"
+	ListSortAccess  = "access"
+	ListSortCreated = "created"
+)
+
+// ErrInvalidListQuery is returned for a bad query parameter on /stats/keys or /stats/servers.
+var ErrInvalidListQuery = errors.New("invalid list query")
+
+// CachePage is one page of cached users or servers.
+type CachePage struct {
+	// Total is how many items matched the filters, before paging.
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Items  []*CacheItem `json:"items"`
+}
+
+// CacheItem is a cached user or server. API keys are masked unless unmask=true is requested and allowed.
+type CacheItem struct {
+	Key        string             `json:"key"`
+	Data       *userinfo.UserInfo `json:"data"`
+	Created    time.Time          `json:"created"`
+	LastAccess time.Time          `json:"lastAccess"`
+	Hits       int64              `json:"hits"`
+}
+
+// listQuery is the parsed query string of a list request.
+type listQuery struct {
+	limit       int
+	offset      int
+	sort        string
+	environment string
+	username    string
+	userID      string
+	minAge      time.Duration
+	maxAge      time.Duration
+	unmask      bool
+}
+
+// parseListQuery reads the paging, filter and sort parameters.
+func parseListQuery(query url.Values) (*listQuery, error) {
+	list := &listQuery{
+		limit:       defaultListLimit,
+		sort:        ListSortKey,
+		environment: query.Get("environment"),
+		username:    query.Get("username"),
+		userID:      query.Get("userId"),
+	}
+
+	var err error
+
+	if list.limit, err = intParam(query, "limit", defaultListLimit); err != nil {
+		return nil, err
+	} else if list.limit < 1 || list.limit > maxListLimit {
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidListQuery, maxListLimit)
+	}
+
+	if list.offset, err = intParam(query, "offset", 0); err != nil {
+		return nil, err
+	} else if list.offset < 0 {
+		return nil, fmt.Errorf("%w: offset must not be negative", ErrInvalidListQuery)
+	}
+
+	if list.minAge, err = durationParam(query, "minAge"); err != nil {
+		return nil, err
+	}
+
+	if list.maxAge, err = durationParam(query, "maxAge"); err != nil {
+		return nil, err
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		if list.sort = strings.ToLower(sort); !slices.Contains([]string{ListSortKey, ListSortAccess, ListSortCreated}, list.sort) {
+			return nil, fmt.Errorf("%w: sort must be key, access or created", ErrInvalidListQuery)
+		}
+	}
+
+	if list.unmask, err = unmaskParam(query); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// unmaskParam returns the unmask query parameter. Full API keys also require the admin allow_unmask setting.
+func unmaskParam(query url.Values) (bool, error) {
+	unmask := query.Get("unmask")
+	if unmask == "" {
+		return false, nil
+	}
+
+	value, err := strconv.ParseBool(unmask)
+	if err != nil {
+		return false, fmt.Errorf("%w: unmask: %w", ErrInvalidListQuery, err)
+	}
+
+	return value, nil
+}
+
+func intParam(query url.Values, name string, def int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %w", ErrInvalidListQuery, name, err)
+	}
+
+	return number, nil
+}
+
+func durationParam(query url.Values, name string) (time.Duration, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	dur, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %w", ErrInvalidListQuery, name, err)
+	}
+
+	return dur, nil
+}
+
+// page filters, sorts and pages the cached items. maskKeys masks the map keys too; they are API keys
+// in the users cache, and server IDs in the servers cache.
+func (l *listQuery) page(items map[string]*cache.Item, maskKeys bool, now time.Time) *CachePage {
+	matched := make([]*CacheItem, 0, len(items))
+
+	for key, item := range items {
+		user, ok := item.Data.(*userinfo.UserInfo)
+		if !ok || !l.matches(user, now.Sub(cachedAt(user, item.Time))) {
+			continue
+		}
+
+		matched = append(matched, &CacheItem{
+			Key:        key,
+			Data:       user,
+			Created:    cachedAt(user, item.Time),
+			LastAccess: item.Last,
+			Hits:       item.Hits,
+		})
+	}
+
+	slices.SortFunc(matched, l.compare)
+
+	list := &CachePage{Total: len(matched), Offset: l.offset, Limit: l.limit}
+	start := min(l.offset, len(matched)) // offset+limit may overflow.
+	list.Items = matched[start : start+min(l.limit, len(matched)-start)]
+
+	if l.unmask {
+		return list
+	}
+
+	for _, item := range list.Items {
+		masked := *item.Data // do not change the cached user.
+		masked.APIKey, _ = maskAPIKey(masked.APIKey)
+		item.Data = &masked
+
+		if maskKeys {
+			item.Key, _ = maskAPIKey(item.Key)
+		}
+	}
+
+	return list
+}
+
+func (l *listQuery) matches(user *userinfo.UserInfo, age time.Duration) bool {
+	return (l.environment == "" || l.environment == user.Environment) &&
+		(l.username == "" || strings.EqualFold(l.username, user.Username)) &&
+		(l.userID == "" || l.userID == user.UserID) &&
+		(l.minAge == 0 || age >= l.minAge) &&
+		(l.maxAge == 0 || age <= l.maxAge)
+}
+
+// compare sorts by key, or newest first by last access or creation, then by key.
+func (l *listQuery) compare(a, b *CacheItem) int {
+	var cmp int
+
+	switch l.sort {
+	case ListSortAccess:
+		cmp = b.LastAccess.Compare(a.LastAccess)
+	case ListSortCreated:
+		cmp = b.Created.Compare(a.Created)
+	}
+
+	if cmp != 0 {
+		return cmp
+	}
+
+	return strings.Compare(a.Key, b.Key)
+}
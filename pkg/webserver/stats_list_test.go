@@ -0,0 +1,184 @@
+//nolint:testpackage // Tests the unexported list query.
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+	"golift.io/cache"
+)
+
+func testListItems(now time.Time) map[string]*cache.Item {
+	items := map[string]*cache.Item{}
+
+	for idx, user := range []*userinfo.UserInfo{
+		{APIKey: "aaaa0000-0000-0000-0000-000000000001", Environment: "live", Username: "alice", UserID: "1"},
+		{APIKey: "bbbb0000-0000-0000-0000-000000000002", Environment: "live", Username: "bob", UserID: "2"},
+		{APIKey: "cccc0000-0000-0000-0000-000000000003", Environment: "dev", Username: "carol", UserID: "3"},
+	} {
+		age := time.Duration(idx+1) * time.Hour // alice is the newest.
+		items[user.APIKey] = &cache.Item{Data: user, Time: now.Add(-age), Last: now.Add(age)}
+	}
+
+	return items
+}
+
+func TestListQuery_page(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	items := testListItems(now)
+
+	tests := []struct {
+		query string
+		want  []string // user IDs in order.
+		total int
+	}{
+		{query: "", want: []string{"1", "2", "3"}, total: 3},
+		{query: "limit=2&offset=1", want: []string{"2", "3"}, total: 3},
+		{query: "offset=5", want: []string{}, total: 3},
+		{query: "offset=9223372036854775807", want: []string{}, total: 3},
+		{query: "limit=1000&offset=2", want: []string{"3"}, total: 3},
+		{query: "environment=live", want: []string{"1", "2"}, total: 2},
+		{query: "username=BOB", want: []string{"2"}, total: 1},
+		{query: "userId=3", want: []string{"3"}, total: 1},
+		{query: "minAge=90m&maxAge=2h", want: []string{"2"}, total: 1},
+		{query: "sort=access", want: []string{"3", "2", "1"}, total: 3},
+		{query: "sort=created&limit=1", want: []string{"1"}, total: 3},
+	}
+
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+
+		query, err := parseListQuery(values)
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		page := query.page(items, true, now)
+		if page.Total != test.total || len(page.Items) != len(test.want) {
+			t.Fatalf("%q: total %d with %d items, want %d with %v", test.query, page.Total, len(page.Items), test.total, test.want)
+		}
+
+		for idx, item := range page.Items {
+			if item.Data.UserID != test.want[idx] {
+				t.Fatalf("%q: item %d is user %s, want %v", test.query, idx, item.Data.UserID, test.want)
+			}
+		}
+	}
+}
+
+func TestListQuery_masking(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	items := testListItems(now)
+	query, _ := parseListQuery(url.Values{"userId": {"1"}})
+
+	item := query.page(items, true, now).Items[0]
+	if item.Key != "aaaa...01" || item.Data.APIKey != "aaaa...01" {
+		t.Fatalf("masked item: key %q, api key %q", item.Key, item.Data.APIKey)
+	}
+
+	if user, _ := items["aaaa0000-0000-0000-0000-000000000001"].Data.(*userinfo.UserInfo); user.APIKey != "aaaa0000-0000-0000-0000-000000000001" {
+		t.Fatalf("masking changed the cached user: %q", user.APIKey)
+	}
+
+	// Server IDs are not masked.
+	if item := query.page(items, false, now).Items[0]; item.Key != "aaaa0000-0000-0000-0000-000000000001" {
+		t.Fatalf("unmasked cache key: %q", item.Key)
+	}
+
+	query, _ = parseListQuery(url.Values{"userId": {"1"}, "unmask": {"true"}})
+	if item := query.page(items, true, now).Items[0]; item.Data.APIKey != "aaaa0000-0000-0000-0000-000000000001" {
+		t.Fatalf("unmask=true: api key %q", item.Data.APIKey)
+	}
+}
+
+func TestHandeUserList(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	srv.handleAuth(httptest.NewRecorder(), authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+	for query, status := range map[string]int{
+		"limit=0":     http.StatusBadRequest,
+		"offset=-1":   http.StatusBadRequest,
+		"sort=hits":   http.StatusBadRequest,
+		"maxAge=soon": http.StatusBadRequest,
+		"unmask=nah":  http.StatusBadRequest,
+		"unmask=true": http.StatusForbidden,
+		"limit=10":    http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		srv.handeUserList(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stats/keys?"+query, nil))
+
+		if rec.Code != status {
+			t.Fatalf("%q: status %d, want %d", query, rec.Code, status)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.handeUserList(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stats/keys", nil))
+
+	var page CachePage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+
+	masked, _ := maskAPIKey(TestAccessLogAPIKey)
+	if page.Total != 1 || page.Limit != defaultListLimit || page.Items[0].Key != masked || page.Items[0].Data.APIKey != masked {
+		t.Fatalf("default page: %s", rec.Body.String())
+	}
+
+	srv.admin = &adminAuth{unmask: true}
+	rec = httptest.NewRecorder()
+	srv.handeUserList(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stats/keys?unmask=true", nil))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), TestAccessLogAPIKey) {
+		t.Fatalf("allowed unmask: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleSrvInfo_masking(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{Password: "website-secret"})
+	srv.handleAuth(httptest.NewRecorder(), authRequest(map[string]string{HeaderXServer: "1234", HeaderXAPIKey: "website-secret"}))
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stats/server/1234?"+query, nil)
+		req.SetPathValue("key", "1234")
+		rec := httptest.NewRecorder()
+		srv.handleSrvInfo(rec, req)
+
+		return rec
+	}
+
+	masked, _ := maskAPIKey(TestAccessLogAPIKey)
+	if rec := get(""); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), TestAccessLogAPIKey) ||
+		!strings.Contains(rec.Body.String(), masked) {
+		t.Fatalf("default: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := get("unmask=true"); rec.Code != http.StatusForbidden {
+		t.Fatalf("unmask without allow_unmask: status %d, want 403", rec.Code)
+	}
+
+	srv.admin = &adminAuth{unmask: true}
+	if rec := get("unmask=true"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), TestAccessLogAPIKey) {
+		t.Fatalf("allowed unmask: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The cached server keeps its key.
+	if user, _, ok := cacheUserFromGetInto(srv.servers, "1234"); !ok || user.APIKey != TestAccessLogAPIKey {
+		t.Fatalf("cached server changed: %+v", user)
+	}
+}
@@ -0,0 +1,362 @@
+package webserver
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/exp"
+	"github.com/Notifiarr/mysql-auth-proxy/pkg/userinfo"
+)
+
+/* This file tracks the most active user IDs and API keys with space-saving heavy hitter summaries. */
+
+const (
+	defaultTopSize     = 10
+	defaultTopCapacity = 100
+	defaultTopSlot     = time.Minute
+	topKindUser        = "user"
+	topKindKey         = "key"
+)
+
+// TopConfig tracks the user IDs and masked API keys with the most auth requests over sliding windows.
+// Counts are approximate: each window slot keeps Capacity counters, and a new name replaces the smallest.
+type TopConfig struct {
+	// Size is how many user IDs and keys are reported per window. Default: 10.
+	Size int `json:"size,omitempty" toml:"size" xml:"size"`
+	// Capacity is how many counters each slot keeps. More is more accurate. Default: 100, or 10x Size if that is more.
+	Capacity int `json:"capacity,omitempty" toml:"capacity" xml:"capacity"`
+	// Slot is the window granularity. Windows slide by this much. Default: 1m.
+	Slot time.Duration `json:"slot,omitempty" toml:"slot" xml:"slot"`
+	// Windows are the durations reported, rounded up to a multiple of Slot. Default: 1m, 15m and 1h.
+	Windows []time.Duration `json:"windows,omitempty" toml:"windows" xml:"window"`
+}
+
+// TopWindow is the most active user IDs and masked API keys in one window.
+type TopWindow struct {
+	Window string      `json:"window"`
+	Users  []*TopEntry `json:"users"`
+	Keys   []*TopEntry `json:"keys"`
+}
+
+// TopEntry is the approximate request count for a user ID or masked API key.
+type TopEntry struct {
+	ID       string `json:"id"`
+	Requests uint64 `json:"requests"`
+	// Error is how much Requests may be overcounted by.
+	Error uint64 `json:"error"`
+}
+
+// topTracker keeps a ring of slots. Each slot counts the requests in one Slot duration.
+type topTracker struct {
+	size    int
+	slot    time.Duration
+	windows []time.Duration
+	mu      sync.Mutex // protects slots.
+	slots   []*topSlot
+	now     func() time.Time
+}
+
+type topSlot struct {
+	start time.Time // zero when unused.
+	users *spaceSaving
+	keys  *spaceSaving
+}
+
+// newTopTracker returns nil when top tracking is not configured.
+func newTopTracker(config *TopConfig) *topTracker {
+	if config == nil {
+		return nil
+	}
+
+	top := &topTracker{size: config.Size, slot: config.Slot, now: time.Now}
+	if top.size < 1 {
+		top.size = defaultTopSize
+	}
+
+	if top.slot <= 0 {
+		top.slot = defaultTopSlot
+	}
+
+	capacity := config.Capacity
+	if capacity < 1 {
+		capacity = max(defaultTopCapacity, top.size*10) //nolint:mnd // 10x the reported size.
+	}
+
+	capacity = max(capacity, top.size)
+
+	windows := config.Windows
+	if len(windows) == 0 {
+		windows = []time.Duration{time.Minute, 15 * time.Minute, time.Hour}
+	}
+
+	for _, window := range windows {
+		window = max(top.slot, (window+top.slot-1)/top.slot*top.slot)
+		if !slices.Contains(top.windows, window) {
+			top.windows = append(top.windows, window)
+		}
+	}
+
+	slices.Sort(top.windows)
+	top.slots = make([]*topSlot, top.windows[len(top.windows)-1]/top.slot)
+
+	for idx := range top.slots {
+		top.slots[idx] = &topSlot{users: newSpaceSaving(capacity), keys: newSpaceSaving(capacity)}
+	}
+
+	return top
+}
+
+// record counts a request for a user ID and a masked API key. Either may be empty.
+func (t *topTracker) record(userID, maskedKey string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	slot := t.current()
+	if userID != "" {
+		slot.users.incr(userID)
+	}
+
+	if maskedKey != "" {
+		slot.keys.incr(maskedKey)
+	}
+}
+
+// current returns the slot for now, clearing it if it was last used a full ring ago.
+func (t *topTracker) current() *topSlot {
+	start := t.now().Truncate(t.slot)
+	slot := t.slots[int(start.UnixNano()/int64(t.slot))%len(t.slots)]
+
+	if !slot.start.Equal(start) {
+		slot.start = start
+		slot.users.reset()
+		slot.keys.reset()
+	}
+
+	return slot
+}
+
+// top returns the most active user IDs and keys for every window, shortest window first.
+func (t *topTracker) top() []*TopWindow {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := t.now().Truncate(t.slot)
+	windows := make([]*TopWindow, len(t.windows))
+
+	for idx, window := range t.windows {
+		users := map[string]*TopEntry{}
+		keys := map[string]*TopEntry{}
+
+		for _, slot := range t.slots {
+			if !slot.start.IsZero() && current.Sub(slot.start) < window {
+				slot.users.mergeInto(users)
+				slot.keys.mergeInto(keys)
+			}
+		}
+
+		windows[idx] = &TopWindow{
+			Window: shortDuration(window),
+			Users:  topEntries(users, t.size),
+			Keys:   topEntries(keys, t.size),
+		}
+	}
+
+	return windows
+}
+
+// topEntries returns the n entries with the most requests, sorted by requests then id.
+func topEntries(merged map[string]*TopEntry, n int) []*TopEntry {
+	entries := make([]*TopEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b *TopEntry) int {
+		if a.Requests != b.Requests {
+			if a.Requests > b.Requests {
+				return -1
+			}
+
+			return 1
+		}
+
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return entries[:min(n, len(entries))]
+}
+
+// metrics returns the top entries for the authproxy_top_requests metric.
+func (t *topTracker) metrics() []exp.TopCount {
+	var counts []exp.TopCount
+
+	for _, window := range t.top() {
+		for _, entry := range window.Users {
+			counts = append(counts, exp.TopCount{Kind: topKindUser, Window: window.Window, ID: entry.ID, Requests: entry.Requests})
+		}
+
+		for _, entry := range window.Keys {
+			counts = append(counts, exp.TopCount{Kind: topKindKey, Window: window.Window, ID: entry.ID, Requests: entry.Requests})
+		}
+	}
+
+	return counts
+}
+
+// shortDuration formats whole minutes and hours without the zero units, e.g. 15m instead of 15m0s.
+func shortDuration(dur time.Duration) string {
+	str := dur.String()
+	if strings.HasSuffix(str, "m0s") {
+		str = strings.TrimSuffix(str, "0s")
+	}
+
+	if strings.HasSuffix(str, "h0m") {
+		str = strings.TrimSuffix(str, "0m")
+	}
+
+	return str
+}
+
+// recordTop counts a user auth request for the top user IDs and keys.
+// Unknown keys are counted, without a user ID.
+func (s *server) recordTop(res *authResult) {
+	if s.top == nil || res.label != "users" {
+		return
+	}
+
+	userID := res.user.UserID
+	if userID == userinfo.DefaultUserID {
+		userID = ""
+	}
+
+	masked, _ := maskAPIKey(res.key)
+	s.top.record(userID, masked)
+}
+
+// @Description  Retrieve the user IDs and masked API keys with the most auth requests, per window.
+// @Description  Counts are approximate, and may be overcounted by up to the error.
+// @Summary      Return the most active users and keys
+// @Tags         stats
+// @Produce      json
+// @Success      200  {object} []TopWindow "Most active users and keys, shortest window first."
+// @Failure      401  {object} string "invalid request"
+// @Failure      404  {object} string "top tracking is not enabled"
+// @Router       /stats/top [get]
+func (s *server) handleTop(resp http.ResponseWriter, _ *http.Request) {
+	if s.top == nil {
+		http.Error(resp, "top tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	err := json.NewEncoder(resp).Encode(s.top.top())
+	if err != nil {
+		s.Printf("[ERROR] writing response: %v", err)
+	}
+}
+
+// spaceSaving is a space-saving heavy hitter summary. It keeps at most capacity counters.
+// When it is full, a new name takes over the smallest counter, and inherits its count as error.
+type spaceSaving struct {
+	capacity int
+	index    map[string]*topCounter
+	heap     topHeap // smallest count first.
+}
+
+type topCounter struct {
+	name  string
+	count uint64
+	err   uint64
+	pos   int // position in the heap.
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		index:    make(map[string]*topCounter, capacity),
+		heap:     make(topHeap, 0, capacity),
+	}
+}
+
+func (s *spaceSaving) incr(name string) {
+	if counter, ok := s.index[name]; ok {
+		counter.count++
+		heap.Fix(&s.heap, counter.pos)
+
+		return
+	}
+
+	if len(s.heap) < s.capacity {
+		counter := &topCounter{name: name, count: 1}
+		s.index[name] = counter
+		heap.Push(&s.heap, counter)
+
+		return
+	}
+
+	smallest := s.heap[0]
+	delete(s.index, smallest.name)
+	smallest.name, smallest.err = name, smallest.count
+	smallest.count++
+	s.index[name] = smallest
+	heap.Fix(&s.heap, 0)
+}
+
+func (s *spaceSaving) reset() {
+	clear(s.index)
+	clear(s.heap)
+	s.heap = s.heap[:0]
+}
+
+// mergeInto adds the counters to merged. Counts and errors of the same name are summed.
+func (s *spaceSaving) mergeInto(merged map[string]*TopEntry) {
+	for _, counter := range s.heap {
+		entry, ok := merged[counter.name]
+		if !ok {
+			entry = &TopEntry{ID: counter.name}
+			merged[counter.name] = entry
+		}
+
+		entry.Requests += counter.count
+		entry.Error += counter.err
+	}
+}
+
+// topHeap is a container/heap min-heap of counters.
+type topHeap []*topCounter
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *topHeap) Push(x any) {
+	counter, _ := x.(*topCounter)
+	counter.pos = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *topHeap) Pop() any {
+	old := *h
+	counter := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return counter
+}
@@ -0,0 +1,145 @@
+//nolint:testpackage // Tests the unexported top tracker.
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestTop returns a top tracker with a fake clock. Advance the clock with the returned pointer.
+func newTestTop(config *TopConfig) (*topTracker, *time.Time) {
+	top := newTopTracker(config)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	top.now = func() time.Time { return now }
+
+	return top, &now
+}
+
+func TestSpaceSaving(t *testing.T) {
+	t.Parallel()
+
+	summary := newSpaceSaving(3)
+
+	for name, count := range map[string]int{"a": 50, "b": 30, "c": 20} {
+		for range count {
+			summary.incr(name)
+		}
+	}
+
+	// Every new name replaces the smallest counter, so the heavy hitters survive the noise.
+	for idx := range 10 {
+		summary.incr("noise" + strconv.Itoa(idx))
+	}
+
+	merged := map[string]*TopEntry{}
+	summary.mergeInto(merged)
+
+	if len(merged) != 3 || merged["a"] == nil || merged["b"] == nil {
+		t.Fatalf("summary lost a heavy hitter: %v", merged)
+	}
+
+	if merged["a"].Requests != 50 || merged["a"].Error != 0 || merged["b"].Requests != 30 {
+		t.Fatalf("heavy hitters were overcounted: a %+v, b %+v", merged["a"], merged["b"])
+	}
+
+	for name, entry := range merged {
+		if name != "a" && name != "b" && entry.Requests-entry.Error > 1 {
+			t.Fatalf("replaced counter %s: %+v, want at most 1 request after the error", name, entry)
+		}
+	}
+}
+
+func TestTopTracker_windows(t *testing.T) {
+	t.Parallel()
+
+	top, now := newTestTop(&TopConfig{Size: 2, Windows: []time.Duration{time.Minute, 90 * time.Second, 5 * time.Minute}})
+
+	if len(top.windows) != 3 || top.windows[1] != 2*time.Minute || len(top.slots) != 5 {
+		t.Fatalf("windows %v and %d slots, want 1m, 2m, 5m and 5 slots", top.windows, len(top.slots))
+	}
+
+	for range 5 {
+		top.record("1", "key1")
+	}
+
+	*now = now.Add(time.Minute)
+
+	for range 3 {
+		top.record("2", "key2")
+		top.record("3", "")
+	}
+
+	top.record("1", "key1")
+
+	windows := top.top()
+	if len(windows) != 3 || windows[0].Window != "1m" || windows[2].Window != "5m" {
+		t.Fatalf("windows: %+v", windows)
+	}
+
+	// The last minute has users 2 and 3 with 3 requests each, and user 1 with 1.
+	if users := windows[0].Users; len(users) != 2 || users[0].ID != "2" || users[1].ID != "3" || users[0].Requests != 3 {
+		t.Fatalf("1m users: %+v %+v", users[0], users[1])
+	}
+
+	if users := windows[1].Users; users[0].ID != "1" || users[0].Requests != 6 {
+		t.Fatalf("2m users: %+v, want user 1 with 6 requests", users[0])
+	}
+
+	if keys := windows[1].Keys; len(keys) != 2 || keys[0].ID != "key1" || keys[1].ID != "key2" {
+		t.Fatalf("2m keys: %+v", keys)
+	}
+
+	// The first minute's slot falls out of the 2m window, then is reused for a new minute.
+	*now = now.Add(5 * time.Minute)
+	top.record("4", "key4")
+
+	windows = top.top()
+	if users := windows[2].Users; len(users) != 1 || users[0].ID != "4" {
+		t.Fatalf("5m users after the ring wrapped: %+v", users)
+	}
+}
+
+func TestHandleTop(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+
+	rec := httptest.NewRecorder()
+	srv.handleTop(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stats/top", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("disabled top tracking: status %d, want 404", rec.Code)
+	}
+
+	srv.top = newTopTracker(&TopConfig{Windows: []time.Duration{time.Minute}})
+
+	for _, key := range []string{TestAccessLogAPIKey, TestAccessLogAPIKey, "unknown-key-000000000000000000000000"} {
+		srv.handleAuth(httptest.NewRecorder(), authRequest(map[string]string{HeaderXAPIKey: key}))
+	}
+
+	rec = httptest.NewRecorder()
+	srv.handleTop(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stats/top", nil))
+
+	var windows []*TopWindow
+	if err := json.Unmarshal(rec.Body.Bytes(), &windows); err != nil || len(windows) != 1 {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+
+	masked, _ := maskAPIKey(TestAccessLogAPIKey)
+	if users := windows[0].Users; len(users) != 1 || users[0].ID != "1001" || users[0].Requests != 2 {
+		t.Fatalf("users: %s, want only user 1001 with 2 requests", rec.Body.String())
+	}
+
+	if keys := windows[0].Keys; len(keys) != 2 || keys[0].ID != masked || keys[0].Requests != 2 {
+		t.Fatalf("keys: %s, want %s first and the unknown key", rec.Body.String(), masked)
+	}
+
+	if metrics := srv.top.metrics(); len(metrics) != 3 || metrics[0].Kind != topKindUser || metrics[0].Window != "1m" {
+		t.Fatalf("metrics: %+v", metrics)
+	}
+}
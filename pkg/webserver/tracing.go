@@ -0,0 +1,220 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+/* This file contains the optional OpenTelemetry tracing of auth requests and backend queries. */
+
+// OTLP export protocols.
+const (
+	TracingProtocolGRPC = "grpc"
+	TracingProtocolHTTP = "http"
+)
+
+const (
+	tracerName         = "github.com/Notifiarr/mysql-auth-proxy/pkg/webserver"
+	defaultServiceName = "authproxy"
+)
+
+// Span attributes that are not in the semantic conventions.
+const (
+	attrLabel    = attribute.Key("authproxy.label")     // users or servers.
+	attrCacheHit = attribute.Key("authproxy.cache_hit") // the user was found in the cache.
+	attrKey      = attribute.Key("authproxy.key")       // masked API key or server ID.
+	attrStale    = attribute.Key("authproxy.stale")     // a stale user was served because the backend failed.
+)
+
+// TracingConfig exports a span per auth request, with child spans for the cache lookup and the
+// backend query, to an OTLP collector. An incoming W3C traceparent header is continued.
+type TracingConfig struct {
+	// Endpoint is the collector: host:port for grpc, or a URL for http. Empty disables tracing.
+	Endpoint string `json:"endpoint" toml:"endpoint" xml:"endpoint"`
+	// Protocol is grpc or http. Default: grpc.
+	Protocol string `json:"protocol,omitempty" toml:"protocol" xml:"protocol"`
+	// Insecure disables TLS to the collector.
+	Insecure bool `json:"insecure,omitempty" toml:"insecure" xml:"insecure"`
+	// ServiceName is the service.name resource attribute. Default: authproxy.
+	ServiceName string `json:"serviceName,omitempty" toml:"service_name" xml:"service_name"`
+	// SampleRatio is the fraction of new traces to record, from 0 to 1. Default: 1.
+	// Traces continued from a traceparent follow the parent's sampling decision.
+	SampleRatio float64 `json:"sampleRatio,omitempty" toml:"sample_ratio" xml:"sample_ratio"`
+}
+
+// ErrInvalidTracing is returned when the tracing config has an unknown protocol.
+var ErrInvalidTracing = errors.New("invalid tracing config")
+
+//nolint:gochecknoglobals // stateless.
+var tracePropagator = propagation.TraceContext{}
+
+// setupTracing starts the OTLP exporter when tracing is configured.
+// Without it, spans go to a no-op tracer.
+func (s *server) setupTracing(ctx context.Context) error {
+	if s.Tracing == nil || s.Tracing.Endpoint == "" {
+		return nil
+	}
+
+	config := s.Tracing
+	if config.Protocol = strings.ToLower(config.Protocol); config.Protocol == "" {
+		config.Protocol = TracingProtocolGRPC
+	}
+
+	if config.ServiceName == "" {
+		config.ServiceName = defaultServiceName
+	}
+
+	if config.SampleRatio <= 0 {
+		config.SampleRatio = 1
+	}
+
+	exporter, err := newTraceExporter(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	s.traceProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(config.ServiceName))),
+	)
+	s.tracer = s.traceProvider.Tracer(tracerName)
+
+	return nil
+}
+
+func newTraceExporter(ctx context.Context, config *TracingConfig) (*otlptrace.Exporter, error) {
+	var (
+		exporter *otlptrace.Exporter
+		err      error
+	)
+
+	switch config.Protocol {
+	case TracingProtocolGRPC:
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case TracingProtocolHTTP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(config.Endpoint)}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err = otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol %q, use grpc or http", ErrInvalidTracing, config.Protocol)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+
+	return exporter, nil
+}
+
+// stopTracing flushes the queued spans to the collector.
+func (s *server) stopTracing() {
+	if s.traceProvider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.traceProvider.Shutdown(ctx); err != nil {
+		s.Printf("[ERROR] Flushing traces: %v", err)
+	}
+}
+
+// startSpan starts a span with the server's tracer, or a no-op span when tracing is disabled.
+func (s *server) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if s.tracer == nil {
+		return noop.Tracer{}.Start(ctx, name, opts...) //nolint:spancheck // returned to the caller.
+	}
+
+	return s.tracer.Start(ctx, name, opts...) //nolint:spancheck // returned to the caller.
+}
+
+// traceAuth wraps an auth handler with a server span that continues an incoming traceparent.
+// The uri attribute has the API key stripped, like the access log referer.
+func (s *server) traceAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := s.startSpan(ctx, "auth", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		if span.IsRecording() {
+			span.SetAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.URLPath(redactedPath(s.rules(), req.Header)),
+				semconv.ClientAddress(ClientIPForLog(req)),
+			)
+		}
+
+		next(resp, req.WithContext(ctx))
+
+		if capture, ok := resp.(*captureWriter); ok {
+			status, _ := strconv.Atoi(capture.statusCode())
+			endAuthSpan(span, status)
+		}
+	}
+}
+
+// endAuthSpan records the auth response status on a server span.
+func endAuthSpan(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// traceLookup starts the span for a backend query, named after the userinfo method it calls.
+func (s *server) traceLookup(ctx context.Context, keyReq keyReq) (context.Context, trace.Span) {
+	name := "GetInfo"
+	if keyReq.label == "servers" {
+		name = "GetServer"
+	}
+
+	ctx, span := s.startSpan(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	if span.IsRecording() {
+		masked, _ := maskAPIKey(keyReq.key)
+		span.SetAttributes(
+			semconv.DBSystemNameKey.String(s.driverName()),
+			semconv.DBOperationName(name),
+			attrLabel.String(keyReq.label),
+			attrKey.String(masked),
+		)
+	}
+
+	return ctx, span
+}
+
+// endSpan records an error on a span, then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
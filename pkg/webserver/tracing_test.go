@@ -0,0 +1,186 @@
+//nolint:testpackage // Tests the unexported tracing middleware and exporter.
+package webserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+// recordSpans sends the server's spans to a recorder.
+func recordSpans(t *testing.T, srv *server) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	srv.tracer = provider.Tracer(tracerName)
+
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	return recorder
+}
+
+// spanAttrs returns the ended spans by name, with their attributes.
+func spanAttrs(recorder *tracetest.SpanRecorder) map[string]map[attribute.Key]attribute.Value {
+	spans := map[string]map[attribute.Key]attribute.Value{}
+
+	for _, span := range recorder.Ended() {
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, attr := range span.Attributes() {
+			attrs[attr.Key] = attr.Value
+		}
+
+		spans[span.Name()] = attrs
+	}
+
+	return spans
+}
+
+func TestTraceAuth(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	recorder := recordSpans(t, srv)
+	handler := srv.accessLogWrap(srv.traceAuth(srv.handleAuth), io.Discard, "")
+	req := authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey, "Traceparent": testTraceparent})
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := spanAttrs(recorder)
+	masked, _ := maskAPIKey(TestAccessLogAPIKey)
+
+	if auth := spans["auth"]; auth["http.response.status_code"].AsInt64() != http.StatusOK {
+		t.Fatalf("auth span attributes: %v", auth)
+	}
+
+	if cached := spans["cache"]; cached[attrCacheHit].AsBool() || cached[attrLabel].AsString() != "users" {
+		t.Fatalf("cache span attributes: %v", cached)
+	}
+
+	if query := spans["GetInfo"]; query[attrKey].AsString() != masked {
+		t.Fatalf("GetInfo span attributes: %v", query)
+	}
+
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != testTraceID {
+			t.Fatalf("span %s did not continue the incoming trace: %s", span.Name(), span.SpanContext().TraceID())
+		}
+	}
+
+	// The second request is a cache hit, without a query.
+	recorder.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), authRequest(map[string]string{HeaderXAPIKey: TestAccessLogAPIKey}))
+
+	spans = spanAttrs(recorder)
+	if _, ok := spans["GetInfo"]; ok || !spans["cache"][attrCacheHit].AsBool() {
+		t.Fatalf("cached request spans: %v", spans)
+	}
+}
+
+func TestExtAuthzCheck_traced(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, nil)
+	recorder := recordSpans(t, srv)
+
+	_, _ = (&extAuthz{server: srv}).Check(context.Background(),
+		checkRequest("/", map[string]string{"x-api-key": TestAccessLogAPIKey, "traceparent": testTraceparent}))
+
+	for _, span := range recorder.Ended() {
+		if span.Name() == "check" && span.SpanKind() == trace.SpanKindServer &&
+			span.SpanContext().TraceID().String() == testTraceID {
+			return
+		}
+	}
+
+	t.Fatalf("no check span continuing the incoming trace: %v", spanAttrs(recorder))
+}
+
+// fakeCollector is an in-process OTLP trace collector.
+type fakeCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+
+	spans chan string
+}
+
+func (f *fakeCollector) Export(
+	_ context.Context, req *coltracepb.ExportTraceServiceRequest,
+) (*coltracepb.ExportTraceServiceResponse, error) {
+	for _, resource := range req.GetResourceSpans() {
+		for _, scope := range resource.GetScopeSpans() {
+			for _, span := range scope.GetSpans() {
+				f.spans <- span.GetName()
+			}
+		}
+	}
+
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func TestSetupTracing_exportsToCollector(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	collector := &fakeCollector{spans: make(chan string, 10)}
+	grpcServer := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(grpcServer, collector)
+
+	go func() { _ = grpcServer.Serve(listener) }()
+
+	t.Cleanup(grpcServer.Stop)
+
+	srv, _ := newTestServer(t, &Config{Tracing: &TracingConfig{Endpoint: listener.Addr().String(), Insecure: true}})
+	if err := srv.setupTracing(context.Background()); err != nil {
+		t.Fatalf("setupTracing: %v", err)
+	}
+
+	_, span := srv.startSpan(context.Background(), "exported")
+	span.End()
+	srv.stopTracing() // flushes the batch.
+
+	select {
+	case name := <-collector.spans:
+		if name != "exported" {
+			t.Fatalf("collector got span %q", name)
+		}
+	default:
+		t.Fatal("collector got no spans")
+	}
+}
+
+func TestSetupTracing_disabled(t *testing.T) {
+	t.Parallel()
+
+	srv, _ := newTestServer(t, &Config{Tracing: &TracingConfig{}})
+	if err := srv.setupTracing(context.Background()); err != nil || srv.tracer != nil {
+		t.Fatalf("tracing without an endpoint: err %v, tracer %v", err, srv.tracer)
+	}
+
+	if _, span := srv.startSpan(context.Background(), "noop"); span.IsRecording() {
+		t.Fatal("disabled tracing must not record spans")
+	}
+
+	if err := (&server{Config: &Config{Tracing: &TracingConfig{Endpoint: "x", Protocol: "zipkin"}}}).
+		setupTracing(context.Background()); err == nil {
+		t.Fatal("expected an error for an unknown protocol")
+	}
+}